@@ -0,0 +1,248 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The local api lets editor plugins and scripts read and write notes while
+// the app is unlocked. It only listens on the loopback interface and every
+// request needs the token written, along with the address, to api.json in
+// the data dir, a new one for every unlock.
+var localAPI struct {
+	sync.Mutex
+	server *http.Server
+	url    string
+}
+
+type apiNote struct {
+	ID       int64  `json:"id,string"`
+	Rev      int64  `json:"rev,string"`
+	Title    string `json:"title"`
+	Modified string `json:"modified"`
+	Data     string `json:"data,omitempty"`
+}
+
+type apiInfo struct {
+	URL   string `json:"url"`
+	Token string `json:"token"`
+}
+
+func apiInfoPath() (string, error) {
+	dir, err := dataDir()
+	return filepath.Join(dir, "api.json"), err
+}
+
+// apiStart starts the local api, if it isn't running yet
+func apiStart() error {
+	localAPI.Lock()
+	defer localAPI.Unlock()
+	if localAPI.server != nil {
+		return nil
+	}
+	path, err := apiInfoPath()
+	if err != nil {
+		return err
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return err
+	}
+	info := apiInfo{URL: "http://" + ln.Addr().String(), Token: uuid()}
+	bs, err := json.Marshal(info)
+	if err == nil {
+		err = ioutil.WriteFile(path, bs, 0600)
+	}
+	if err != nil {
+		ln.Close()
+		return err
+	}
+	host := ln.Addr().String()
+	localAPI.server = &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			apiServe(w, r, host, info.Token)
+		}),
+		ReadTimeout: 10 * time.Second,
+	}
+	localAPI.url = info.URL
+	go func(server *http.Server) {
+		if err := server.Serve(ln); err != nil && err != http.ErrServerClosed {
+			log.Println("local api:", err)
+		}
+	}(localAPI.server)
+	log.Println("local api: listening on", info.URL)
+	return nil
+}
+
+// apiStop stops the local api and removes its token, if it's running
+func apiStop() {
+	localAPI.Lock()
+	defer localAPI.Unlock()
+	if localAPI.server == nil {
+		return
+	}
+	localAPI.server.Close()
+	localAPI.server = nil
+	localAPI.url = ""
+	if path, err := apiInfoPath(); err == nil {
+		os.Remove(path)
+	}
+}
+
+// apiURL is where the local api listens, empty when it doesn't
+func apiURL() string {
+	localAPI.Lock()
+	defer localAPI.Unlock()
+	return localAPI.url
+}
+
+// apiServe answers:
+//
+//	GET /notes?q=<query>  notes matching like the search bar, without data
+//	POST /notes {data}    creates a note
+//	GET /notes/<id>       a note with its data
+//	PUT /notes/<id> {data, rev}  replaces a note's data, if rev is given only
+//	                      when it's still the note's rev, empty data deletes
+func apiServe(w http.ResponseWriter, r *http.Request, host, token string) {
+	// web pages can reach loopback addresses, with a rebound dns name too
+	if r.Host != host || r.Header.Get("Origin") != "" {
+		apiError(w, 403, "forbidden", "only local tools may use this api")
+		return
+	}
+	auth := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if subtle.ConstantTimeCompare([]byte(auth), []byte(token)) != 1 {
+		apiError(w, 401, "invalid_token", "missing or invalid token, see api.json in the data dir")
+		return
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, 1<<20)
+
+	path := strings.Trim(r.URL.Path, "/")
+	if path == "notes" && r.Method == "GET" {
+		apiList(w, strings.ToLower(r.URL.Query().Get("q")))
+		return
+	} else if path == "notes" && r.Method == "POST" {
+		apiSave(w, r, 0)
+		return
+	} else if !strings.HasPrefix(path, "notes/") {
+		apiError(w, 404, "not_found", "no such endpoint")
+		return
+	}
+	id, err := strconv.ParseInt(strings.TrimPrefix(path, "notes/"), 10, 64)
+	if err != nil {
+		apiError(w, 404, "not_found", "invalid note id")
+		return
+	}
+	switch r.Method {
+	case "GET":
+		layoutLock.Lock()
+		i, ok := items[id]
+		var note apiNote
+		if ok {
+			note = apiNoteOf(i)
+			note.Data = i.Data
+		}
+		layoutLock.Unlock()
+		if !ok || i.Data == "" {
+			apiError(w, 404, "not_found", "no such note")
+			return
+		}
+		apiWrite(w, 200, note)
+	case "PUT":
+		apiSave(w, r, id)
+	default:
+		apiError(w, 405, "method_not_allowed", "method not allowed")
+	}
+}
+
+func apiList(w http.ResponseWriter, query string) {
+	layoutLock.Lock()
+	notes := []apiNote{}
+	for _, i := range items {
+		if searchMatch(i, query) {
+			notes = append(notes, apiNoteOf(i))
+		}
+	}
+	layoutLock.Unlock()
+	sort.Slice(notes, func(a, b int) bool {
+		return notes[a].Rev > notes[b].Rev
+	})
+	apiWrite(w, 200, notes)
+}
+
+// apiSave creates a note, when noteID is 0, or updates one, and hands it to
+// the same save loop as the editor
+func apiSave(w http.ResponseWriter, r *http.Request, noteID int64) {
+	in := apiNote{}
+	if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
+		apiError(w, 400, "invalid_body", "invalid body: "+err.Error())
+		return
+	}
+	if noteID == 0 && strings.TrimSpace(in.Data) == "" {
+		apiError(w, 400, "invalid_body", "empty note")
+		return
+	}
+
+	layoutLock.Lock()
+	if len(dataKey) == 0 || page == "unlock" {
+		layoutLock.Unlock()
+		apiError(w, 503, "locked", "the app is locked")
+		return
+	}
+	i, ok := items[noteID]
+	if noteID != 0 && (!ok || i.Data == "") {
+		layoutLock.Unlock()
+		apiError(w, 404, "not_found", "no such note")
+		return
+	}
+	if noteID != 0 && in.Rev != 0 && in.Rev != i.Rev {
+		layoutLock.Unlock()
+		apiError(w, 409, "conflict", "the note changed since rev "+strconv.FormatInt(in.Rev, 10))
+		return
+	}
+	status := 200
+	if noteID == 0 {
+		i = &Item{ID: id()}
+		items[i.ID] = i
+		status = 201
+	}
+	i.Rev = id()
+	i.Data = in.Data
+	if page == "note" && pageSubject.(*Item).ID == i.ID {
+		noteEditor.SetText(i.Data)
+	} else if page == "search" {
+		updateSearchResults()
+	}
+	note := apiNoteOf(i)
+	note.Data = i.Data
+	layoutLock.Unlock()
+
+	saveChan <- i
+	syncLater()
+	invalidate()
+	apiWrite(w, status, note)
+}
+
+func apiNoteOf(i *Item) apiNote {
+	return apiNote{ID: i.ID, Rev: i.Rev, Title: noteTitle(i.Data), Modified: idTime(i.Rev).UTC().Format(time.RFC3339)}
+}
+
+func apiWrite(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func apiError(w http.ResponseWriter, status int, code, message string) {
+	apiWrite(w, status, map[string]string{"error": code, "message": message})
+}
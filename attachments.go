@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/gob"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"image"
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"gioui.org/op/paint"
+)
+
+// maxAttachmentSize leaves room for sealing under the server's blob limit
+const maxAttachmentSize = 63 << 20
+
+// attachmentRe finds references to attachments in notes, images starting
+// with a !, an attachment's id is the sha256 of it sealed
+var attachmentRe = regexp.MustCompile(`(!?)\[([^\]\n]*)\]\(attachment:([0-9a-f]{64})\)`)
+
+// attachment is a file attached to notes, stored sealed in the attachments
+// table and synced as a blob apart from the notes so they stay small
+type attachment struct {
+	Name string
+	Type string
+	Data []byte
+}
+
+// attachmentAdd stores the file at path, a plain path or a file:// url, and
+// returns the markdown referencing it
+func attachmentAdd(path string) (string, error) {
+	path = strings.Trim(strings.TrimSpace(path), `"'`)
+	if strings.HasPrefix(path, "file://") {
+		var err error
+		if path, err = url.PathUnescape(strings.TrimPrefix(path, "file://")); err != nil {
+			return "", err
+		}
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return "", err
+	}
+	if info.IsDir() {
+		return "", errors.New("folders can't be attached")
+	}
+	if info.Size() > maxAttachmentSize {
+		return "", fmt.Errorf("attachments can't be larger than %dMB", maxAttachmentSize>>20)
+	}
+	bs, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	a := attachment{Name: filepath.Base(path), Type: mime.TypeByExtension(filepath.Ext(path)), Data: bs}
+	if a.Type == "" {
+		a.Type = http.DetectContentType(bs)
+	}
+	var b bytes.Buffer
+	if err := gob.NewEncoder(&b).Encode(a); err != nil {
+		return "", err
+	}
+	id, err := attachmentSeal(b.Bytes())
+	if err != nil {
+		return "", err
+	}
+
+	name := strings.NewReplacer("[", "(", "]", ")", "\n", " ").Replace(a.Name)
+	if strings.HasPrefix(a.Type, "image/") {
+		return "![" + name + "](attachment:" + id + ")", nil
+	}
+	return "[" + name + "](attachment:" + id + ")", nil
+}
+
+// attachmentSeal stores the gob of an attachment sealed and returns its id,
+// sealed the same on every device so attaching a file twice stores it once
+func attachmentSeal(bs []byte) (string, error) {
+	sealed := sealConvergent(subKey(dataKey, "attachments"), bs)
+	sum := sha256.Sum256(sealed)
+	id := hex.EncodeToString(sum[:])
+	return id, attachmentSave(id, sealed, false)
+}
+
+var errAttachmentMissing = errors.New("not downloaded yet")
+
+// attachmentOpen reads an attachment, errAttachmentMissing until a sync
+// brings it
+func attachmentOpen(id string) (*attachment, error) {
+	data, err := attachmentLoad(id)
+	if err != nil {
+		return nil, err
+	}
+	if data == nil {
+		return nil, errAttachmentMissing
+	}
+	bs, err := unseal(subKey(dataKey, "attachments"), data)
+	if err != nil {
+		return nil, err
+	}
+	a := &attachment{}
+	return a, gob.NewDecoder(bytes.NewReader(bs)).Decode(a)
+}
+
+type attachmentImage struct {
+	op      paint.ImageOp
+	err     error
+	loading bool
+}
+
+// attachmentImages caches the decoded images shown under notes, layoutLock
+// must be held
+var attachmentImages = map[string]*attachmentImage{}
+
+// attachmentImageFor returns the image with id, loading it in the background
+// the first time, layoutLock must be held
+func attachmentImageFor(id string) *attachmentImage {
+	if i, ok := attachmentImages[id]; ok {
+		return i
+	}
+	i := &attachmentImage{loading: true}
+	attachmentImages[id] = i
+	go func() {
+		var img image.Image
+		a, err := attachmentOpen(id)
+		if err == nil {
+			img, _, err = image.Decode(bytes.NewReader(a.Data))
+		}
+		layoutLock.Lock()
+		defer layoutLock.Unlock()
+		i.loading = false
+		i.err = err
+		if err == nil {
+			i.op = paint.NewImageOp(img)
+		}
+		invalidate()
+	}()
+	return i
+}
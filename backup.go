@@ -0,0 +1,329 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"golang.org/x/crypto/pbkdf2"
+)
+
+// A backup file is backupMagic, a mode byte, a salt and the gzipped gob of a
+// backupData sealed with AES-GCM, everything before it as additional data so
+// the header can't be tampered with either
+const backupMagic = "nervosbak1\n"
+
+const (
+	// sealed under a key derived from the vault key, the password's data key
+	backupVaultKey = 0
+	// sealed under a key derived from a passphrase and the salt
+	backupPassphrase = 1
+)
+
+const backupSaltSize = 16
+
+var errBackupOpen = errors.New("wrong password or passphrase, or a damaged backup")
+
+type backupData struct {
+	Created  int64
+	Settings backupSettings
+	// every stored revision, the latest of each note as that's all we keep,
+	// so backups have no history, deleted notes included so restoring
+	// doesn't bring them back
+	Items []*Item
+	// the attachments by the id notes refer to them with, opened so they can
+	// be sealed again when restoring under another password, which changes
+	// their ids
+	Attachments map[string][]byte
+}
+
+// backupSettings are the settings worth keeping, without the password check
+// and the device id
+type backupSettings struct {
+	Version          int64
+	Username         string
+	RememberUsername bool
+	LastSync         int64
+	LastSyncTime     int64
+}
+
+// backupWrite writes all items to path, sealed with the vault key, or with
+// passphrase when there is one
+func backupWrite(path string, passphrase []byte) (int, error) {
+	all, err := itemsLoad(dataKey)
+	if err != nil {
+		return 0, err
+	}
+	attachments, err := backupAttachments()
+	if err != nil {
+		return 0, err
+	}
+	backup := backupData{
+		Created: time.Now().Unix(),
+		Settings: backupSettings{settings.Version, settings.Username, settings.RememberUsername,
+			settings.LastSync, settings.LastSyncTime},
+		Items:       all,
+		Attachments: attachments,
+	}
+	var payload bytes.Buffer
+	zw := gzip.NewWriter(&payload)
+	if err := gob.NewEncoder(zw).Encode(backup); err != nil {
+		return 0, err
+	}
+	if err := zw.Close(); err != nil {
+		return 0, err
+	}
+
+	header := []byte(backupMagic)
+	salt := make([]byte, backupSaltSize)
+	if len(passphrase) > 0 {
+		if _, err := rand.Read(salt); err != nil {
+			return 0, err
+		}
+		header = append(header, backupPassphrase)
+	} else {
+		header = append(header, backupVaultKey)
+	}
+	header = append(header, salt...)
+	bs := append(header, sealWith(backupKey(header, passphrase), payload.Bytes(), header)...)
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return 0, err
+	}
+	// written aside then renamed so a failure doesn't leave half a backup
+	if err := ioutil.WriteFile(path+".tmp", bs, 0600); err != nil {
+		return 0, err
+	}
+	return len(all), os.Rename(path+".tmp", path)
+}
+
+// backupAttachments opens the attachments this device has, the ones not
+// downloaded yet are left to the server
+func backupAttachments() (map[string][]byte, error) {
+	ids, err := attachmentIDs(false)
+	if err != nil {
+		return nil, err
+	}
+	attachments := map[string][]byte{}
+	for _, id := range ids {
+		data, err := attachmentLoad(id)
+		if err != nil {
+			return nil, err
+		} else if data == nil {
+			continue
+		}
+		if attachments[id], err = unseal(subKey(dataKey, "attachments"), data); err != nil {
+			return nil, fmt.Errorf("attachment %s: %v", id, err)
+		}
+	}
+	return attachments, nil
+}
+
+// backupRead opens the backup at path, a passphrase is only needed for
+// backups sealed with one
+func backupRead(path string, passphrase []byte) (*backupData, error) {
+	bs, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	headerSize := len(backupMagic) + 1 + backupSaltSize
+	if len(bs) < headerSize || string(bs[:len(backupMagic)]) != backupMagic {
+		return nil, errors.New("not a nervos backup")
+	}
+	header := bs[:headerSize]
+	mode := header[len(backupMagic)]
+	if mode != backupVaultKey && mode != backupPassphrase {
+		return nil, fmt.Errorf("unknown backup mode %d", mode)
+	}
+	if mode == backupPassphrase && len(passphrase) == 0 {
+		return nil, errors.New("this backup needs its passphrase")
+	}
+	if mode == backupVaultKey {
+		passphrase = nil
+	}
+	payload, err := unsealWith(backupKey(header, passphrase), bs[headerSize:], header)
+	if err != nil {
+		return nil, errBackupOpen
+	}
+	zr, err := gzip.NewReader(bytes.NewReader(payload))
+	if err != nil {
+		return nil, err
+	}
+	backup := &backupData{}
+	if err := gob.NewDecoder(zr).Decode(backup); err != nil {
+		return nil, err
+	}
+	seen := map[int64]bool{}
+	for _, i := range backup.Items {
+		if i == nil || i.ID == 0 || i.Rev == 0 || seen[i.ID] {
+			return nil, errors.New("inconsistent backup")
+		}
+		seen[i.ID] = true
+	}
+	return backup, nil
+}
+
+// backupKey is the key a backup with header is sealed with, the salt is only
+// used with a passphrase
+func backupKey(header, passphrase []byte) []byte {
+	if len(passphrase) == 0 {
+		return subKey(dataKey, "backup")
+	}
+	salt := header[len(header)-backupSaltSize:]
+	return pbkdf2.Key(passphrase, salt, 100000, 32, sha256.New)
+}
+
+// backupRestore merges a backup into the items, a note is only replaced by a
+// later revision of it, so restoring twice or an older backup is harmless.
+// Restored notes get a new rev for the next sync to send them everywhere.
+// Attachments are sealed again, under new ids when the password changed,
+// which the restored notes are updated to. A dry run only counts the notes it
+// would restore.
+func backupRestore(backup *backupData, dryRun bool) (restored int, err error) {
+	all, err := itemsLoad(dataKey)
+	if err != nil {
+		return 0, err
+	}
+	renamed := map[string]string{}
+	for id, bs := range backup.Attachments {
+		if dryRun {
+			break
+		}
+		sealedID, err := attachmentSeal(bs)
+		if err != nil {
+			return 0, err
+		}
+		if sealedID != id {
+			renamed[id] = sealedID
+		}
+	}
+	stored := map[int64]*Item{}
+	for _, i := range all {
+		stored[i.ID] = i
+	}
+	for _, b := range backup.Items {
+		if s, ok := stored[b.ID]; ok && s.Rev >= b.Rev {
+			continue
+		}
+		if dryRun {
+			restored++
+			continue
+		}
+		i := *b
+		i.Data = attachmentRe.ReplaceAllStringFunc(i.Data, func(link string) string {
+			m := attachmentRe.FindStringSubmatch(link)
+			if id, ok := renamed[m[3]]; ok {
+				return m[1] + "[" + m[2] + "](attachment:" + id + ")"
+			}
+			return link
+		})
+		// a new rev, an old one could be behind another device's checkpoint
+		// which would then never get it
+		i.Rev = id()
+		if err := itemsSave(dataKey, &i); err != nil {
+			return restored, err
+		}
+		layoutLock.Lock()
+		items[i.ID] = &i
+		layoutLock.Unlock()
+		restored++
+	}
+	if !dryRun && settings.Username == "" && settings.RememberUsername {
+		settings.Username = backup.Settings.Username
+		err = settingsSave(dataKey, settings)
+	}
+	return restored, err
+}
+
+// backupPath is where the app backs up to, next to the exports
+func backupPath() (string, error) {
+	dir, err := exportDir()
+	name := "nervos-" + time.Now().Format("2006-01-02") + ".nervosbak"
+	return filepath.Join(filepath.Dir(dir), name), err
+}
+
+// backupCommand is `nervos backup [-p] <file>`, -p sealing it with a
+// passphrase instead of the vault key, for restoring under another password
+func backupCommand(args []string) error {
+	usePassphrase := len(args) > 0 && args[0] == "-p"
+	if usePassphrase {
+		args = args[1:]
+	}
+	if len(args) != 1 {
+		return errors.New("usage: nervos backup [-p] <file.nervosbak>")
+	}
+	if err := unlockTerminal(); err != nil {
+		return err
+	}
+	var passphrase []byte
+	if usePassphrase {
+		var err error
+		if passphrase, err = terminalNewPassword("Backup passphrase"); err != nil {
+			return err
+		}
+	}
+	n, err := backupWrite(args[0], passphrase)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("backed up %d notes to %s\n", n, args[0])
+	return nil
+}
+
+// restoreCommand is `nervos restore [-p] <file>`, it works on a device that
+// never logged in too, the password then sets up the database for that user
+func restoreCommand(args []string) error {
+	usePassphrase := len(args) > 0 && args[0] == "-p"
+	if usePassphrase {
+		args = args[1:]
+	}
+	if len(args) != 1 {
+		return errors.New("usage: nervos restore [-p] <file.nervosbak>")
+	}
+	if err := openTerminal(); err != nil {
+		return err
+	}
+	fresh := len(settings.PasswordCheck) == 0
+	password, err := terminalCredentials()
+	if err != nil {
+		return err
+	}
+	if fresh && !terminalSecretSet() {
+		again, err := terminalPassword("Password again")
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(password, again) {
+			return errors.New("passwords don't match")
+		}
+	}
+	var passphrase []byte
+	if usePassphrase {
+		if passphrase, err = terminalPassword("Backup passphrase"); err != nil {
+			return err
+		}
+	}
+	// the backup is opened before unlocking, which sets up a fresh database
+	deriveKeys(password)
+	backup, err := backupRead(args[0], passphrase)
+	if err != nil {
+		return err
+	}
+	if err := unlockData(password); err != nil {
+		return err
+	}
+	n, err := backupRestore(backup, false)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("restored %d of %d notes from a backup of %s\n", n, len(backup.Items),
+		time.Unix(backup.Created, 0).Format("2006-01-02 15:04"))
+	return nil
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"time"
+)
+
+// captureCommand is `nervos capture [-to <title> | -daily] [text]`, it saves
+// its arguments, or stdin, as a new note or at the end of the note titled
+// title, or today's, for the next sync to send
+func captureCommand(args []string) error {
+	flags := flag.NewFlagSet("capture", flag.ContinueOnError)
+	to := flags.String("to", "", "append to the note with this title, such as Inbox, creating it if needed")
+	daily := flags.Bool("daily", false, "append to today's note, titled with the date")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *to != "" && *daily {
+		return errors.New("usage: nervos capture [-to <title> | -daily] [text]")
+	}
+	// unlocked first, the password can be piped in ahead of the text
+	if err := unlockTerminal(); err != nil {
+		return err
+	}
+	text := strings.Join(flags.Args(), " ")
+	if text == "" {
+		bs, err := ioutil.ReadAll(terminalInput)
+		if err != nil {
+			return err
+		}
+		text = string(bs)
+	}
+	if strings.TrimSpace(text) == "" {
+		return errors.New("nothing to capture")
+	}
+	i := captureNote(*to, *daily, text, time.Now())
+	if err := cliSave(i); err != nil {
+		return err
+	}
+	fmt.Println(i.ID)
+	return nil
+}
+
+// captureNote makes a note of text, or appends it under a timestamp heading
+// to the note titled to, or today's note when daily
+func captureNote(to string, daily bool, text string, now time.Time) *Item {
+	text = strings.TrimSpace(strings.ReplaceAll(text, "\r\n", "\n"))
+	heading := now.Format("2006-01-02 15:04")
+	if daily {
+		to = now.Format("2006-01-02")
+		heading = now.Format("15:04")
+	}
+	if to == "" {
+		i := &Item{ID: id(), Data: text + "\n"}
+		i.Rev = i.ID
+		return i
+	}
+
+	var note *Item
+	for _, i := range items {
+		if i.Data != "" && strings.EqualFold(noteTitle(i.Data), to) && (note == nil || i.Rev > note.Rev) {
+			note = i
+		}
+	}
+	if note == nil {
+		note = &Item{ID: id(), Data: "# " + to + "\n"}
+	}
+	note.Rev = id()
+	note.Data = strings.TrimRight(note.Data, "\n") + "\n\n## " + heading + "\n\n" + text + "\n"
+	return note
+}
@@ -0,0 +1,401 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/ssh/terminal"
+)
+
+// commands run instead of the app when named as the first argument, they
+// unlock with a password read from the terminal or NERVOS_PASSWORD, or
+// printed by NERVOS_PASSWORD_COMMAND, such as a keyring lookup
+var commands = map[string]func([]string) error{
+	"ls":      lsCommand,
+	"show":    showCommand,
+	"new":     newCommand,
+	"edit":    editCommand,
+	"search":  searchCommand,
+	"rm":      rmCommand,
+	"sync":    syncCommand,
+	"capture": captureCommand,
+	"export":  exportCommand,
+	"import":  importCommand,
+	"backup":  backupCommand,
+	"restore": restoreCommand,
+	"signup":  signupCommand,
+}
+
+// terminalInput reads stdin for all commands, so a password piped in ahead
+// of a note doesn't swallow the beginning of it
+var terminalInput = bufio.NewReader(os.Stdin)
+
+// lsCommand is `nervos ls`, notes last modified first
+func lsCommand(args []string) error {
+	if len(args) != 0 {
+		return errors.New("usage: nervos ls")
+	}
+	if err := unlockTerminal(); err != nil {
+		return err
+	}
+	cliList("")
+	return nil
+}
+
+// searchCommand is `nervos search <query>`, matching like the search bar
+func searchCommand(args []string) error {
+	if len(args) == 0 {
+		return errors.New("usage: nervos search <query>")
+	}
+	if err := unlockTerminal(); err != nil {
+		return err
+	}
+	cliList(strings.ToLower(strings.Join(args, " ")))
+	return nil
+}
+
+func cliList(query string) {
+	notes := []*Item{}
+	for _, i := range items {
+		if searchMatch(i, query) {
+			notes = append(notes, i)
+		}
+	}
+	sort.Slice(notes, func(a, b int) bool {
+		return notes[a].Rev > notes[b].Rev
+	})
+	for _, i := range notes {
+		fmt.Printf("%d  %s  %s\n", i.ID, idTime(i.Rev).Format("2006-01-02 15:04"), noteTitle(i.Data))
+	}
+}
+
+// showCommand is `nervos show <id>`
+func showCommand(args []string) error {
+	if len(args) != 1 {
+		return errors.New("usage: nervos show <id>")
+	}
+	if err := unlockTerminal(); err != nil {
+		return err
+	}
+	i, err := cliNote(args[0])
+	if err != nil {
+		return err
+	}
+	fmt.Print(i.Data)
+	if !strings.HasSuffix(i.Data, "\n") {
+		fmt.Println()
+	}
+	return nil
+}
+
+// newCommand is `nervos new [text]`, the text being read from stdin when
+// piped or written in $EDITOR otherwise
+func newCommand(args []string) error {
+	if err := unlockTerminal(); err != nil {
+		return err
+	}
+	text := strings.Join(args, " ")
+	var err error
+	if text == "" && !terminal.IsTerminal(int(os.Stdin.Fd())) {
+		var bs []byte
+		bs, err = ioutil.ReadAll(terminalInput)
+		text = string(bs)
+	} else if text == "" {
+		text, err = cliEditor("")
+	}
+	if err != nil {
+		return err
+	}
+	if strings.TrimSpace(text) == "" {
+		return errors.New("empty note, nothing saved")
+	}
+	i := &Item{ID: id(), Data: text}
+	i.Rev = i.ID
+	if err := cliSave(i); err != nil {
+		return err
+	}
+	fmt.Println(i.ID)
+	return nil
+}
+
+// editCommand is `nervos edit <id>`, the note is saved if it changed
+func editCommand(args []string) error {
+	if len(args) != 1 {
+		return errors.New("usage: nervos edit <id>")
+	}
+	if err := unlockTerminal(); err != nil {
+		return err
+	}
+	i, err := cliNote(args[0])
+	if err != nil {
+		return err
+	}
+	text, err := cliEditor(i.Data)
+	if err != nil {
+		return err
+	}
+	if text == i.Data {
+		return nil
+	}
+	if strings.TrimSpace(text) == "" {
+		return errors.New("empty note, use nervos rm to delete it")
+	}
+	i.Rev = id()
+	i.Data = text
+	return cliSave(i)
+}
+
+// rmCommand is `nervos rm <id>`, the note is emptied, which is how deletions
+// reach other devices
+func rmCommand(args []string) error {
+	if len(args) != 1 {
+		return errors.New("usage: nervos rm <id>")
+	}
+	if err := unlockTerminal(); err != nil {
+		return err
+	}
+	i, err := cliNote(args[0])
+	if err != nil {
+		return err
+	}
+	i.Rev = id()
+	i.Data = ""
+	return cliSave(i)
+}
+
+// syncCommand is `nervos sync`, other commands only queue their changes for
+// the next sync
+func syncCommand(args []string) error {
+	if len(args) != 0 {
+		return errors.New("usage: nervos sync")
+	}
+	if err := unlockTerminal(); err != nil {
+		return err
+	}
+	before := len(items)
+	pending := syncPending()
+	if err := syncChanges(); err != nil {
+		return err
+	}
+	fmt.Printf("synced, %d changes sent, %d new notes\n", pending, len(items)-before)
+	return nil
+}
+
+// signupCommand is `nervos signup [invite]`, creating an account on the
+// server like the app's create account button, and logging this device in
+func signupCommand(args []string) error {
+	if len(args) > 1 {
+		return errors.New("usage: nervos signup [invite]")
+	}
+	if err := openTerminal(); err != nil {
+		return err
+	}
+	if len(settings.PasswordCheck) > 0 {
+		return errors.New("this device is logged in already")
+	}
+	password, err := terminalCredentials()
+	if err != nil {
+		return err
+	}
+	if !terminalSecretSet() {
+		again, err := terminalPassword("Password again")
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(password, again) {
+			return errors.New("passwords don't match")
+		}
+	}
+	invite := ""
+	if len(args) == 1 {
+		invite = args[0]
+	}
+	deriveKeys(password)
+	settings.DeviceID = uuid()
+	if err := syncSignup(invite); err != nil {
+		return err
+	}
+	if err := unlockData(password); err != nil {
+		return err
+	}
+	fmt.Println("created account", settings.Username)
+	return nil
+}
+
+func cliNote(arg string) (*Item, error) {
+	id, err := strconv.ParseInt(arg, 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid note id %q", arg)
+	}
+	i, ok := items[id]
+	if !ok || i.Data == "" {
+		return nil, fmt.Errorf("no note %d", id)
+	}
+	return i, nil
+}
+
+func cliSave(i *Item) error {
+	if err := itemsSave(dataKey, i); err != nil {
+		return err
+	}
+	items[i.ID] = i
+	return nil
+}
+
+// cliEditor lets the user edit text in $EDITOR, the note is in clear in a
+// temporary file only readable by the user for as long as the editor is open
+func cliEditor(text string) (string, error) {
+	editor := os.Getenv("VISUAL")
+	if editor == "" {
+		editor = os.Getenv("EDITOR")
+	}
+	if editor == "" && runtime.GOOS == "windows" {
+		editor = "notepad"
+	} else if editor == "" {
+		editor = "vi"
+	}
+	f, err := ioutil.TempFile("", "nervos-*.md")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(f.Name())
+	_, err = f.WriteString(text)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return "", err
+	}
+	fields := strings.Fields(editor)
+	cmd := exec.Command(fields[0], append(fields[1:], f.Name())...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("%s: %v", editor, err)
+	}
+	bs, err := ioutil.ReadFile(f.Name())
+	return string(bs), err
+}
+
+// unlockTerminal opens the database and unlocks it with credentials read
+// from the terminal
+func unlockTerminal() error {
+	if err := openTerminal(); err != nil {
+		return err
+	}
+	if len(settings.PasswordCheck) == 0 {
+		return errors.New("no notes on this device yet, log in with the app first or create an account with nervos signup")
+	}
+	password, err := terminalCredentials()
+	if err != nil {
+		return err
+	}
+	return unlockData(password)
+}
+
+// openTerminal opens the database and loads the settings, still locked
+func openTerminal() error {
+	dir, err := dataDir()
+	if err != nil {
+		return err
+	}
+	if err := dbInit(filepath.Join(dir, "nervos.db")); err != nil {
+		return err
+	}
+	settings, err = settingsLoad()
+	return err
+}
+
+// terminalCredentials gets the username, unless remembered, from
+// NERVOS_USERNAME or the terminal, and the password, see terminalSecret
+func terminalCredentials() ([]byte, error) {
+	if settings.Username == "" {
+		settings.Username = os.Getenv("NERVOS_USERNAME")
+	}
+	if settings.Username == "" {
+		fmt.Fprint(os.Stderr, "Username: ")
+		username, err := terminalInput.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		settings.Username = strings.TrimSpace(username)
+	}
+	password, ok, err := terminalSecret()
+	if ok || err != nil {
+		return password, err
+	}
+	return terminalPassword("Password")
+}
+
+// terminalSecret is the password from the environment, if there is one, so
+// commands can run unattended
+func terminalSecret() ([]byte, bool, error) {
+	if !terminalSecretSet() {
+		return nil, false, nil
+	}
+	if password := os.Getenv("NERVOS_PASSWORD"); password != "" {
+		return []byte(password), true, nil
+	}
+	command := os.Getenv("NERVOS_PASSWORD_COMMAND")
+	cmd := exec.Command("sh", "-c", command)
+	if runtime.GOOS == "windows" {
+		cmd = exec.Command("cmd", "/c", command)
+	}
+	cmd.Stdin, cmd.Stderr = os.Stdin, os.Stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, true, fmt.Errorf("NERVOS_PASSWORD_COMMAND: %v", err)
+	}
+	return bytes.TrimRight(out, "\r\n"), true, nil
+}
+
+func terminalSecretSet() bool {
+	return os.Getenv("NERVOS_PASSWORD") != "" || os.Getenv("NERVOS_PASSWORD_COMMAND") != ""
+}
+
+// terminalPassword asks for a password without echoing it, or reads a line
+// when stdin isn't a terminal
+func terminalPassword(prompt string) ([]byte, error) {
+	fmt.Fprint(os.Stderr, prompt+": ")
+	if !terminal.IsTerminal(int(os.Stdin.Fd())) {
+		line, err := terminalInput.ReadString('\n')
+		fmt.Fprintln(os.Stderr)
+		if err != nil && (err != io.EOF || line == "") {
+			return nil, err
+		}
+		return []byte(strings.TrimRight(line, "\r\n")), nil
+	}
+	password, err := terminal.ReadPassword(int(os.Stdin.Fd()))
+	fmt.Fprintln(os.Stderr)
+	return password, err
+}
+
+// terminalNewPassword asks for a password twice, as a typo would lock the
+// user out of what it protects
+func terminalNewPassword(prompt string) ([]byte, error) {
+	password, err := terminalPassword(prompt)
+	if err != nil {
+		return nil, err
+	}
+	if len(password) == 0 {
+		return nil, errors.New("empty " + strings.ToLower(prompt))
+	}
+	again, err := terminalPassword(prompt + " again")
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(password, again) {
+		return nil, errors.New(strings.ToLower(prompt) + "s don't match")
+	}
+	return password, nil
+}
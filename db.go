@@ -1,7 +1,13 @@
 package main
 
 import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
 	"database/sql"
+	"encoding/binary"
+	"encoding/gob"
+	"fmt"
 	"log"
 	"os"
 	"path/filepath"
@@ -9,11 +15,37 @@ import (
 	_ "github.com/mattn/go-sqlite3"
 )
 
+// Data formats, stored in Settings.Version
+const (
+	// item data encrypted with textEncrypt, ids, revs and sync state in clear
+	formatLegacy = 1
+	// items and sync state sealed with AES-GCM, item ids replaced by keyed hashes
+	formatSealed = 2
+	// password checked against a MAC of a random value, see passwordVerifier
+	formatVerifier = 3
+	// notes sent to the server sealed, replacing the copies sent in clear
+	formatSyncSealed = 4
+)
+
 type Settings struct {
-	Version       int64
-	Username      string
-	PasswordCheck []byte
-	LastSync      int64
+	Version          int64
+	Username         string
+	RememberUsername bool
+	PasswordCheck    []byte
+	LastSync         int64
+	LastSyncTime     int64 // unix time of the last successful sync
+	DeviceID         string
+	LocalAPI         bool // serve the local api while unlocked
+
+	sealed []byte
+}
+
+// sealedSettings holds the settings that are only readable once unlocked
+type sealedSettings struct {
+	LastSync     int64
+	DeviceID     string
+	LastSyncTime int64
+	LocalAPI     bool
 }
 
 type Item struct {
@@ -22,6 +54,15 @@ type Item struct {
 	Data string
 }
 
+// Schema migrations, applied in order and tracked with sqlite's user_version
+var migrations = []string{
+	`create table if not exists settings (version int, username text, password_check blob, last_sync int);
+	create table if not exists items (id int primary key, rev int, data blob);`,
+	`alter table settings add column remember_username int not null default 1;
+	alter table settings add column sealed blob;`,
+	`create table if not exists attachments (id text primary key, data blob, synced int not null default 0);`,
+}
+
 func dbInit(path string) error {
 	log.Println("database: opening:", path)
 	var err error
@@ -35,55 +76,254 @@ func dbInit(path string) error {
 	if err != nil {
 		return err
 	}
-	_, err = db.Exec("create table if not exists settings (version int, username text, password_check blob, last_sync int);")
+	var version int
+	if err := db.QueryRow("pragma user_version;").Scan(&version); err != nil {
+		return err
+	}
+	for ; version < len(migrations); version++ {
+		log.Println("database: migrating to", version+1)
+		if err := dbMigrate(version); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// dbMigrate runs a migration along with its version bump, so an interrupted
+// one runs again from the start next time
+func dbMigrate(version int) error {
+	tx, err := db.Begin()
 	if err != nil {
 		return err
 	}
-	_, err = db.Exec("create table if not exists items (id int primary key, rev int, data blob);")
-	return err
+	defer tx.Rollback()
+	if _, err := tx.Exec(migrations[version]); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(fmt.Sprintf("pragma user_version = %d;", version+1)); err != nil {
+		return err
+	}
+	return tx.Commit()
 }
 
 func settingsLoad() (*Settings, error) {
 	settings := &Settings{}
-	row := db.QueryRow("select version, username, password_check, last_sync from settings limit 1;")
-	err := row.Scan(&settings.Version, &settings.Username, &settings.PasswordCheck, &settings.LastSync)
+	row := db.QueryRow("select version, username, remember_username, password_check, last_sync, sealed from settings limit 1;")
+	err := row.Scan(&settings.Version, &settings.Username, &settings.RememberUsername,
+		&settings.PasswordCheck, &settings.LastSync, &settings.sealed)
 	if err != nil && err != sql.ErrNoRows {
 		return nil, err
 	}
 	if settings.Version == 0 {
-		settings.Version = 1
-		sql := "insert into settings (version, username, password_check, last_sync) values (?, ?, ?, ?);"
-		if _, err := db.Exec(sql, 1, "", []byte{}, 0); err != nil {
+		// there's nothing to migrate yet, new databases start at the latest
+		// format
+		settings.Version = formatSyncSealed
+		settings.RememberUsername = true
+		sql := "insert into settings (version, username, remember_username, password_check, last_sync, sealed) values (?, ?, ?, ?, ?, ?);"
+		if _, err := db.Exec(sql, settings.Version, "", true, []byte{}, 0, []byte{}); err != nil {
 			return nil, err
 		}
 	}
 	return settings, nil
 }
 
-func settingsSave(s *Settings) error {
-	_, err := db.Exec("update settings set version = ?, username = ?, password_check = ?, last_sync = ?;",
-		s.Version, s.Username, s.PasswordCheck, s.LastSync)
+// settingsUnseal fills in the settings that are sealed with key
+func settingsUnseal(key []byte, s *Settings) error {
+	if s.Version < formatSealed || len(s.sealed) == 0 {
+		return nil
+	}
+	bs, err := unseal(key, s.sealed)
+	if err != nil {
+		return err
+	}
+	ss := sealedSettings{}
+	if err := gob.NewDecoder(bytes.NewReader(bs)).Decode(&ss); err != nil {
+		return err
+	}
+	s.LastSync = ss.LastSync
+	s.DeviceID = ss.DeviceID
+	s.LastSyncTime = ss.LastSyncTime
+	s.LocalAPI = ss.LocalAPI
+	return nil
+}
+
+func settingsSave(key []byte, s *Settings) error {
+	username := s.Username
+	if !s.RememberUsername {
+		username = ""
+	}
+	lastSync := s.LastSync
+	if s.Version >= formatSealed {
+		var bs bytes.Buffer
+		if err := gob.NewEncoder(&bs).Encode(sealedSettings{s.LastSync, s.DeviceID, s.LastSyncTime, s.LocalAPI}); err != nil {
+			return err
+		}
+		s.sealed = seal(key, bs.Bytes())
+		lastSync = 0
+	}
+	_, err := db.Exec("update settings set version = ?, username = ?, remember_username = ?, password_check = ?, last_sync = ?, sealed = ?;",
+		s.Version, username, s.RememberUsername, s.PasswordCheck, lastSync, s.sealed)
 	return err
 }
 
+// itemRowID maps an item id to the opaque id it is stored under
+func itemRowID(key []byte, id int64) int64 {
+	m := hmac.New(sha256.New, subKey(key, "items"))
+	binary.Write(m, binary.BigEndian, id)
+	return int64(binary.BigEndian.Uint64(m.Sum(nil)) >> 1)
+}
+
 func itemsLoad(key []byte) ([]*Item, error) {
 	items := []*Item{}
-	rows, err := db.Query("select id, rev, data from items;")
+	rows, err := db.Query("select data from items;")
 	if err != nil {
 		return nil, err
 	}
+	defer rows.Close()
 	for rows.Next() {
-		item := &Item{}
 		data := []byte{}
-		err = rows.Scan(&item.ID, &item.Rev, &data)
-		item.Data = textDecrypt(key, data)
+		if err := rows.Scan(&data); err != nil {
+			return nil, err
+		}
+		bs, err := unseal(key, data)
+		if err != nil {
+			return nil, err
+		}
+		item := &Item{}
+		if err := gob.NewDecoder(bytes.NewReader(bs)).Decode(item); err != nil {
+			return nil, err
+		}
 		items = append(items, item)
 	}
 	return items, rows.Err()
 }
 
+func itemSeal(key []byte, i *Item) ([]byte, error) {
+	var bs bytes.Buffer
+	if err := gob.NewEncoder(&bs).Encode(i); err != nil {
+		return nil, err
+	}
+	return seal(key, bs.Bytes()), nil
+}
+
+// itemsSnapshot copies the items, for the goroutines going through them
+// while the app edits notes in place
+func itemsSnapshot() []Item {
+	layoutLock.Lock()
+	defer layoutLock.Unlock()
+	snapshot := make([]Item, 0, len(items))
+	for _, i := range items {
+		snapshot = append(snapshot, *i)
+	}
+	return snapshot
+}
+
 func itemsSave(key []byte, i *Item) error {
-	_, err := db.Exec("insert into items (id, rev, data) values (?, ?, ?) on conflict (id) do update set data = excluded.data;",
-		i.ID, i.Rev, textEncrypt(key, i.Data))
+	data, err := itemSeal(key, i)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec("insert into items (id, rev, data) values (?, 0, ?) on conflict (id) do update set data = excluded.data;",
+		itemRowID(key, i.ID), data)
+	return err
+}
+
+// itemsMigrate rewrites items stored in the legacy format as sealed items,
+// and records the new format in the same transaction, as rewritten items
+// could not be told apart from legacy ones if the app stopped in between
+func itemsMigrate(key []byte) error {
+	items := []*Item{}
+	rows, err := db.Query("select id, rev, data from items;")
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+		item := &Item{}
+		data := []byte{}
+		if err := rows.Scan(&item.ID, &item.Rev, &data); err != nil {
+			rows.Close()
+			return err
+		}
+		item.Data = textDecrypt(key, data)
+		items = append(items, item)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec("delete from items;"); err != nil {
+		return err
+	}
+	for _, i := range items {
+		data, err := itemSeal(key, i)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec("insert into items (id, rev, data) values (?, 0, ?);", itemRowID(key, i.ID), data)
+		if err != nil {
+			return err
+		}
+	}
+	if _, err := tx.Exec("update settings set version = ?;", formatSealed); err != nil {
+		return err
+	}
+	log.Printf("database: migrated %d items", len(items))
+	return tx.Commit()
+}
+
+// attachmentSave stores a sealed attachment under its id, the sha256 of data,
+// synced once the server has it
+func attachmentSave(id string, data []byte, synced bool) error {
+	_, err := db.Exec("insert into attachments (id, data, synced) values (?, ?, ?) on conflict (id) do update set synced = max(synced, excluded.synced);",
+		id, data, synced)
+	return err
+}
+
+// attachmentLoad returns a sealed attachment, nil if we don't have it
+func attachmentLoad(id string) ([]byte, error) {
+	data := []byte{}
+	err := db.QueryRow("select data from attachments where id = ?;", id).Scan(&data)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return data, err
+}
+
+// attachmentIDs lists the attachments we have, the ones the server doesn't
+// have yet when unsynced
+func attachmentIDs(unsynced bool) ([]string, error) {
+	query := "select id from attachments;"
+	if unsynced {
+		query = "select id from attachments where synced = 0;"
+	}
+	rows, err := db.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	ids := []string{}
+	for rows.Next() {
+		id := ""
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+func attachmentSynced(id string) error {
+	_, err := db.Exec("update attachments set synced = 1 where id = ?;", id)
+	return err
+}
+
+func attachmentDelete(id string) error {
+	_, err := db.Exec("delete from attachments where id = ?;", id)
 	return err
 }
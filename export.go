@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+var tagRe = regexp.MustCompile(`(?:^|\s)#([\p{L}\p{N}_/-]*[\p{L}_/-][\p{L}\p{N}_/-]*)`)
+
+// exportManifest lists, in the export dir, the files the last export wrote,
+// the only ones a later export replaces or removes
+const exportManifest = ".nervos-export"
+
+// exportNotes writes every note to dir as <title-slug>.md with yaml front
+// matter. The output only depends on the notes, so exporting to a folder kept
+// in git gives readable diffs. Files from earlier exports whose note is gone
+// are removed, other files are left alone, a note whose name is taken by one
+// getting a number.
+func exportNotes(dir string) (int, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return 0, err
+	}
+	stale := map[string]bool{}
+	bs, err := ioutil.ReadFile(filepath.Join(dir, exportManifest))
+	if err != nil && !os.IsNotExist(err) {
+		return 0, err
+	}
+	for _, name := range strings.Split(string(bs), "\n") {
+		if name != "" && name == filepath.Base(name) {
+			stale[name] = true
+		}
+	}
+
+	notes := []*Item{}
+	for _, i := range itemsSnapshot() {
+		if i.Data != "" {
+			i := i
+			notes = append(notes, &i)
+		}
+	}
+	sort.Slice(notes, func(a, b int) bool {
+		return notes[a].ID < notes[b].ID
+	})
+	used := map[string]bool{}
+	written := []string{}
+	for _, i := range notes {
+		slug := noteSlug(noteTitle(i.Data))
+		name := slug + ".md"
+		for n := 2; used[name] || !exportOurs(dir, name, i, stale); n++ {
+			name = slug + "-" + strconv.Itoa(n) + ".md"
+		}
+		used[name] = true
+		delete(stale, name)
+		written = append(written, name)
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(exportNote(i)), 0600); err != nil {
+			return 0, err
+		}
+	}
+	sort.Strings(written)
+	manifest := strings.Join(written, "\n") + "\n"
+	if err := ioutil.WriteFile(filepath.Join(dir, exportManifest), []byte(manifest), 0600); err != nil {
+		return 0, err
+	}
+	for name := range stale {
+		if err := os.Remove(filepath.Join(dir, name)); err != nil && !os.IsNotExist(err) {
+			return 0, err
+		}
+	}
+	return len(notes), nil
+}
+
+// exportOurs tells whether i can be written to name, which is when nothing is
+// there, an earlier export wrote it or it holds i already, exported before
+// there was a manifest
+func exportOurs(dir, name string, i *Item, written map[string]bool) bool {
+	if written[name] {
+		return true
+	}
+	bs, err := ioutil.ReadFile(filepath.Join(dir, name))
+	if os.IsNotExist(err) {
+		return true
+	}
+	return err == nil && bytes.HasPrefix(bs, []byte(fmt.Sprintf("---\nid: %d\n", i.ID)))
+}
+
+func exportNote(i *Item) string {
+	var b strings.Builder
+	b.WriteString("---\n")
+	fmt.Fprintf(&b, "id: %d\n", i.ID)
+	fmt.Fprintf(&b, "created: %s\n", idTime(i.ID).UTC().Format(time.RFC3339))
+	fmt.Fprintf(&b, "modified: %s\n", idTime(i.Rev).UTC().Format(time.RFC3339))
+	fmt.Fprintf(&b, "tags: [%s]\n", strings.Join(noteTags(i.Data), ", "))
+	b.WriteString("---\n")
+	b.WriteString(i.Data)
+	if !strings.HasSuffix(i.Data, "\n") {
+		b.WriteString("\n")
+	}
+	return b.String()
+}
+
+// noteTitle is the note's first line without its heading marks
+func noteTitle(data string) string {
+	return strings.TrimSpace(strings.Trim(strings.SplitN(data, "\n", 2)[0], "# "))
+}
+
+// noteTags finds the #tags in a note, sorted and without duplicates
+func noteTags(data string) []string {
+	seen := map[string]bool{}
+	tags := []string{}
+	for _, m := range tagRe.FindAllStringSubmatch(data, -1) {
+		tag := strings.ToLower(m[1])
+		if !seen[tag] {
+			seen[tag] = true
+			tags = append(tags, tag)
+		}
+	}
+	sort.Strings(tags)
+	return tags
+}
+
+func noteSlug(title string) string {
+	var b strings.Builder
+	dash := false
+	for _, r := range strings.ToLower(title) {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			if dash && b.Len() > 0 {
+				b.WriteByte('-')
+			}
+			b.WriteRune(r)
+			dash = false
+		} else {
+			dash = true
+		}
+		if b.Len() >= 60 {
+			break
+		}
+	}
+	if b.Len() == 0 {
+		return "untitled"
+	}
+	return b.String()
+}
+
+// exportDir is where the app exports to, there being no folder picker
+func exportDir() (string, error) {
+	dir, err := os.UserHomeDir()
+	if runtime.GOOS == "ios" {
+		// only the app's documents are reachable from the files app
+		dir, err = dataDir()
+	}
+	return filepath.Join(dir, "nervos-export"), err
+}
+
+// exportCommand is `nervos export <dir>`, it unlocks the data asking for the
+// username, unless remembered, and password on the terminal
+func exportCommand(args []string) error {
+	if len(args) != 1 {
+		return errors.New("usage: nervos export <dir>")
+	}
+	if err := unlockTerminal(); err != nil {
+		return err
+	}
+	n, err := exportNotes(args[0])
+	if err != nil {
+		return err
+	}
+	fmt.Printf("exported %d notes to %s\n", n, args[0])
+	return nil
+}
@@ -0,0 +1,300 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var wikiLinkRe = regexp.MustCompile(`\[\[([^\[\]|#]*)(#[^\[\]|]*)?(?:\|([^\[\]]*))?\]\]`)
+
+// importReport tells what importNotes did, files are relative to the folder
+type importReport struct {
+	Imported   int
+	Duplicates []string // already a note with the same content
+	Unresolved []string // [[links]] to notes that weren't found
+	Errors     []string
+}
+
+func (r importReport) String() string {
+	s := fmt.Sprintf("%d notes imported", r.Imported)
+	if len(r.Duplicates) > 0 {
+		s += fmt.Sprintf(", %d duplicates skipped", len(r.Duplicates))
+	}
+	if len(r.Unresolved) > 0 {
+		s += fmt.Sprintf(", %d links not found", len(r.Unresolved))
+	}
+	if len(r.Errors) > 0 {
+		s += fmt.Sprintf(", %d errors", len(r.Errors))
+	}
+	return s
+}
+
+type importFile struct {
+	path      string
+	name      string
+	item      *Item
+	tags      []string
+	duplicate bool
+}
+
+// importNotes creates a note for every note found at path, which can be a
+// folder of .md and .txt files, such as an obsidian vault or a folder written
+// by exportNotes, or an export from another app, see importRead. Notes get
+// ids from their creation times, and revs that make the next sync send them.
+// Tags are kept as #tags and [[links]] between notes are rewritten to
+// [text](id), searching for the id finds the note. A dry run only reports
+// what would be imported.
+func importNotes(path string, dryRun bool) (importReport, error) {
+	files, report, err := importRead(path)
+	if err != nil {
+		return report, err
+	}
+
+	existing := map[string]int64{}
+	byTitle := map[string]int64{}
+	taken := map[int64]bool{}
+	for _, i := range itemsSnapshot() {
+		existing[i.Data] = i.ID
+		byTitle[strings.ToLower(noteTitle(i.Data))] = i.ID
+		taken[i.ID] = true
+	}
+	// ids first, so links can point to notes later in the walk
+	for _, f := range files {
+		if id, ok := existing[f.item.Data]; ok {
+			f.duplicate = true
+			byTitle[strings.ToLower(f.name)] = id
+			continue
+		}
+		for taken[f.item.ID] {
+			f.item.ID++
+		}
+		taken[f.item.ID] = true
+		byTitle[strings.ToLower(f.name)] = f.item.ID
+	}
+
+	for _, f := range files {
+		i := f.item
+		if f.duplicate {
+			report.Duplicates = append(report.Duplicates, f.path)
+			continue
+		}
+		i.Data = wikiLinkRe.ReplaceAllStringFunc(i.Data, func(link string) string {
+			m := wikiLinkRe.FindStringSubmatch(link)
+			text := m[3]
+			if text == "" && m[2] != "" {
+				text = m[1] + " > " + strings.TrimPrefix(m[2], "#")
+			} else if text == "" {
+				text = m[1]
+			}
+			if id, ok := byTitle[strings.ToLower(strings.TrimSpace(m[1]))]; ok {
+				return fmt.Sprintf("[%s](%d)", text, id)
+			}
+			report.Unresolved = append(report.Unresolved, f.path+": "+link)
+			return text
+		})
+		present := map[string]bool{}
+		for _, tag := range noteTags(i.Data) {
+			present[tag] = true
+		}
+		missing := []string{}
+		for _, tag := range f.tags {
+			if !present[strings.ToLower(tag)] {
+				missing = append(missing, "#"+tag)
+			}
+		}
+		if len(missing) > 0 {
+			i.Data = strings.TrimRight(i.Data, "\n") + "\n\n" + strings.Join(missing, " ") + "\n"
+		}
+
+		if _, ok := existing[i.Data]; ok {
+			report.Duplicates = append(report.Duplicates, f.path)
+			continue
+		}
+		existing[i.Data] = i.ID
+		report.Imported++
+		if dryRun {
+			continue
+		}
+		// a new rev, one from the file's time could be behind another
+		// device's checkpoint which would then never get the note
+		i.Rev = id()
+		if err := itemsSave(dataKey, i); err != nil {
+			return report, err
+		}
+		layoutLock.Lock()
+		items[i.ID] = i
+		layoutLock.Unlock()
+	}
+	return report, nil
+}
+
+// importRead reads the notes at path, a folder of markdown files, a single
+// one, an evernote .enex export or a simplenote or standard notes .json backup
+func importRead(path string) ([]*importFile, importReport, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, importReport{}, err
+	}
+	if info.IsDir() {
+		return importWalk(path)
+	}
+	bs, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, importReport{}, err
+	}
+	files := []*importFile{}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".enex":
+		files, err = importENEX(bs)
+	case ".json":
+		files, err = importJSON(bs)
+	default:
+		var f *importFile
+		if f, err = importParse(filepath.Base(path), string(bs), info.ModTime()); err == nil {
+			files = append(files, f)
+		}
+	}
+	return files, importReport{}, err
+}
+
+func importWalk(dir string) ([]*importFile, importReport, error) {
+	report := importReport{}
+	files := []*importFile{}
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		rel, _ := filepath.Rel(dir, path)
+		if err != nil {
+			report.Errors = append(report.Errors, rel+": "+err.Error())
+			return nil
+		}
+		if strings.HasPrefix(info.Name(), ".") && path != dir {
+			// .obsidian, .git and the like
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		ext := strings.ToLower(filepath.Ext(path))
+		if info.IsDir() || (ext != ".md" && ext != ".markdown" && ext != ".txt") {
+			return nil
+		}
+		bs, err := ioutil.ReadFile(path)
+		if err != nil {
+			report.Errors = append(report.Errors, rel+": "+err.Error())
+			return nil
+		}
+		f, err := importParse(rel, string(bs), info.ModTime())
+		if err != nil {
+			report.Errors = append(report.Errors, rel+": "+err.Error())
+			return nil
+		}
+		files = append(files, f)
+		return nil
+	})
+	return files, report, err
+}
+
+// importParse reads a file's optional yaml front matter, the id and created
+// time written by exportNotes and tags, as a list or in brackets, notes
+// without a created time being dated by the file's modified time
+func importParse(path, data string, modified time.Time) (*importFile, error) {
+	data = strings.ReplaceAll(data, "\r\n", "\n")
+	name := strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+	f := &importFile{path: path, name: name, item: &Item{}}
+	created := modified
+	id := int64(0)
+	if strings.HasPrefix(data, "---\n") {
+		end := strings.Index(data[3:]+"\n", "\n---\n")
+		if end < 0 {
+			return nil, errors.New("unterminated front matter")
+		}
+		frontMatter := data[min(4, 3+end) : 3+end]
+		data = strings.TrimPrefix(data[min(len(data), 3+end+5):], "\n")
+		key := ""
+		for _, line := range strings.Split(frontMatter, "\n") {
+			if strings.HasPrefix(strings.TrimSpace(line), "- ") && key == "tags" {
+				f.tags = append(f.tags, importTag(strings.TrimSpace(line)[2:]))
+				continue
+			}
+			parts := strings.SplitN(line, ":", 2)
+			if len(parts) != 2 {
+				continue
+			}
+			key = strings.TrimSpace(parts[0])
+			value := strings.TrimSpace(parts[1])
+			switch key {
+			case "id":
+				id, _ = strconv.ParseInt(value, 10, 64)
+			case "created", "date":
+				if t, err := time.Parse(time.RFC3339, value); err == nil {
+					created = t
+				} else if t, err := time.Parse("2006-01-02", value); err == nil {
+					created = t
+				}
+			case "tags":
+				value = strings.Trim(value, "[]")
+				for _, tag := range strings.Split(value, ",") {
+					if tag = importTag(tag); tag != "" {
+						f.tags = append(f.tags, tag)
+					}
+				}
+			}
+		}
+	}
+	if strings.TrimSpace(data) == "" {
+		return nil, errors.New("empty note")
+	}
+	if id == 0 && !strings.HasPrefix(data, "#") {
+		// obsidian notes are titled by their file name
+		data = "# " + name + "\n\n" + data
+	}
+	if id == 0 {
+		id = idAt(created)
+	}
+	f.item.ID = id
+	f.item.Data = data
+	sort.Strings(f.tags)
+	return f, nil
+}
+
+func importTag(tag string) string {
+	return strings.ReplaceAll(strings.Trim(strings.TrimSpace(tag), `"'#`), " ", "-")
+}
+
+// importCommand is `nervos import [-n] <path>`, -n only reporting what would
+// be imported, the notes are sent to the server the next time the app syncs
+func importCommand(args []string) error {
+	dryRun := len(args) > 0 && args[0] == "-n"
+	if dryRun {
+		args = args[1:]
+	}
+	if len(args) != 1 {
+		return errors.New("usage: nervos import [-n] <folder, .enex or .json>")
+	}
+	if err := unlockTerminal(); err != nil {
+		return err
+	}
+	report, err := importNotes(args[0], dryRun)
+	for _, path := range report.Duplicates {
+		fmt.Println("duplicate:", path)
+	}
+	for _, link := range report.Unresolved {
+		fmt.Println("link not found:", link)
+	}
+	for _, e := range report.Errors {
+		fmt.Println("error:", e)
+	}
+	if dryRun {
+		fmt.Println("dry run,", report)
+	} else {
+		fmt.Println(report)
+	}
+	return err
+}
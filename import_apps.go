@@ -0,0 +1,303 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+	"time"
+)
+
+var blankLinesRe = regexp.MustCompile(`\n{3,}`)
+
+// importNote makes an importFile out of a note from another app, titled with
+// a heading unless its first line already is the title, its creation time
+// kept in its id
+func importNote(source, title, body string, tags []string, created time.Time) *importFile {
+	body = strings.TrimSpace(strings.ReplaceAll(body, "\r\n", "\n"))
+	title = strings.TrimSpace(title)
+	if title != "" && noteTitle(body) != title {
+		body = "# " + title + "\n\n" + body
+	}
+	if title == "" {
+		title = noteTitle(body)
+	}
+	for n := range tags {
+		tags[n] = importTag(tags[n])
+	}
+	return &importFile{
+		path: source,
+		name: title,
+		item: &Item{ID: idAt(created), Data: body + "\n"},
+		tags: tags,
+	}
+}
+
+type enexExport struct {
+	Notes []struct {
+		Title   string   `xml:"title"`
+		Content string   `xml:"content"`
+		Created string   `xml:"created"`
+		Tags    []string `xml:"tag"`
+	} `xml:"note"`
+}
+
+// importENEX reads an evernote export, converting the notes' ENML, a subset
+// of xhtml, to markdown
+func importENEX(bs []byte) ([]*importFile, error) {
+	export := enexExport{}
+	d := xml.NewDecoder(bytes.NewReader(bs))
+	d.Strict = false
+	if err := d.Decode(&export); err != nil {
+		return nil, err
+	}
+	files := []*importFile{}
+	for n, note := range export.Notes {
+		body, err := enmlToMarkdown(note.Content)
+		if err != nil {
+			return nil, fmt.Errorf("note %d, %s: %v", n+1, note.Title, err)
+		}
+		created := enexTime(note.Created)
+		files = append(files, importNote(fmt.Sprintf("%d: %s", n+1, note.Title), note.Title, body,
+			note.Tags, created))
+	}
+	return files, nil
+}
+
+func enexTime(s string) time.Time {
+	t, err := time.Parse("20060102T150405Z", s)
+	if err != nil {
+		return time.Now()
+	}
+	return t
+}
+
+// enmlToMarkdown converts the common ENML elements to markdown, dropping the
+// markup it doesn't know about but keeping its text
+func enmlToMarkdown(enml string) (string, error) {
+	d := xml.NewDecoder(strings.NewReader(enml))
+	d.Strict = false
+	d.AutoClose = xml.HTMLAutoClose
+	d.Entity = xml.HTMLEntity
+	var b strings.Builder
+	lists := []string{} // "ul" or the next number of each open list
+	href := ""
+	pre := false
+	for {
+		t, err := d.Token()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return "", err
+		}
+		switch t := t.(type) {
+		case xml.StartElement:
+			switch t.Name.Local {
+			case "div", "p", "table", "tr":
+				b.WriteString("\n")
+			case "br":
+				b.WriteString("\n")
+			case "h1", "h2", "h3", "h4", "h5", "h6":
+				b.WriteString("\n\n" + strings.Repeat("#", int(t.Name.Local[1]-'0')) + " ")
+			case "b", "strong":
+				b.WriteString("**")
+			case "i", "em":
+				b.WriteString("_")
+			case "code":
+				if !pre {
+					b.WriteString("`")
+				}
+			case "pre":
+				pre = true
+				b.WriteString("\n```\n")
+			case "hr":
+				b.WriteString("\n\n---\n\n")
+			case "ul":
+				lists = append(lists, "ul")
+			case "ol":
+				lists = append(lists, "1")
+			case "li":
+				b.WriteString("\n" + strings.Repeat("  ", max(0, len(lists)-1)))
+				if len(lists) > 0 && lists[len(lists)-1] != "ul" {
+					b.WriteString(lists[len(lists)-1] + ". ")
+					var next int
+					fmt.Sscan(lists[len(lists)-1], &next)
+					lists[len(lists)-1] = fmt.Sprint(next + 1)
+				} else {
+					b.WriteString("- ")
+				}
+			case "en-todo":
+				if enmlAttr(t, "checked") == "true" {
+					b.WriteString("[x] ")
+				} else {
+					b.WriteString("[ ] ")
+				}
+			case "en-media":
+				b.WriteString("[attachment " + enmlAttr(t, "type") + "]")
+			case "a":
+				href = enmlAttr(t, "href")
+				b.WriteString("[")
+			case "td", "th":
+				b.WriteString(" | ")
+			}
+		case xml.EndElement:
+			switch t.Name.Local {
+			case "div", "p":
+				b.WriteString("\n")
+			case "h1", "h2", "h3", "h4", "h5", "h6":
+				b.WriteString("\n\n")
+			case "b", "strong":
+				b.WriteString("**")
+			case "i", "em":
+				b.WriteString("_")
+			case "code":
+				if !pre {
+					b.WriteString("`")
+				}
+			case "pre":
+				pre = false
+				b.WriteString("\n```\n")
+			case "ul", "ol":
+				if len(lists) > 0 {
+					lists = lists[:len(lists)-1]
+				}
+				if len(lists) == 0 {
+					b.WriteString("\n")
+				}
+			case "a":
+				b.WriteString("](" + href + ")")
+				href = ""
+			}
+		case xml.CharData:
+			text := string(t)
+			if !pre {
+				text = strings.Join(strings.Fields(text), " ")
+				if len(t) > 0 && strings.TrimSpace(string(t)) != "" {
+					if isSpace(t[0]) {
+						text = " " + text
+					}
+					if isSpace(t[len(t)-1]) {
+						text += " "
+					}
+				} else if len(t) > 0 && !strings.HasSuffix(b.String(), "\n") {
+					text = " "
+				}
+			}
+			b.WriteString(text)
+		}
+	}
+	lines := strings.Split(b.String(), "\n")
+	for n := range lines {
+		lines[n] = strings.TrimRight(lines[n], " ")
+	}
+	return strings.TrimSpace(blankLinesRe.ReplaceAllString(strings.Join(lines, "\n"), "\n\n")), nil
+}
+
+func enmlAttr(e xml.StartElement, name string) string {
+	for _, a := range e.Attr {
+		if a.Name.Local == name {
+			return a.Value
+		}
+	}
+	return ""
+}
+
+func isSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r'
+}
+
+type simplenoteBackup struct {
+	ActiveNotes []struct {
+		ID           string   `json:"id"`
+		Content      string   `json:"content"`
+		CreationDate string   `json:"creationDate"`
+		Tags         []string `json:"tags"`
+	} `json:"activeNotes"`
+}
+
+type standardNotesBackup struct {
+	Items []struct {
+		UUID        string          `json:"uuid"`
+		ContentType string          `json:"content_type"`
+		Content     json.RawMessage `json:"content"`
+		CreatedAt   string          `json:"created_at"`
+		Deleted     bool            `json:"deleted"`
+	} `json:"items"`
+}
+
+type standardNotesContent struct {
+	Title      string `json:"title"`
+	Text       string `json:"text"`
+	Trashed    bool   `json:"trashed"`
+	References []struct {
+		UUID string `json:"uuid"`
+	} `json:"references"`
+}
+
+// importJSON reads a simplenote or a decrypted standard notes backup, trashed
+// notes are left out
+func importJSON(bs []byte) ([]*importFile, error) {
+	probe := map[string]json.RawMessage{}
+	if err := json.Unmarshal(bs, &probe); err != nil {
+		return nil, err
+	}
+	files := []*importFile{}
+	if _, ok := probe["activeNotes"]; ok {
+		backup := simplenoteBackup{}
+		if err := json.Unmarshal(bs, &backup); err != nil {
+			return nil, err
+		}
+		for _, note := range backup.ActiveNotes {
+			files = append(files, importNote("simplenote "+note.ID, "", note.Content, note.Tags,
+				jsonTime(note.CreationDate)))
+		}
+		return files, nil
+	}
+	if _, ok := probe["items"]; !ok {
+		return nil, errors.New("not a simplenote or standard notes backup")
+	}
+
+	backup := standardNotesBackup{}
+	if err := json.Unmarshal(bs, &backup); err != nil {
+		return nil, err
+	}
+	contents := make([]standardNotesContent, len(backup.Items))
+	tags := map[string][]string{}
+	for n, item := range backup.Items {
+		if len(item.Content) > 0 && item.Content[0] == '"' {
+			return nil, errors.New("encrypted standard notes backup, export a decrypted one")
+		}
+		if item.Deleted || len(item.Content) == 0 {
+			continue
+		}
+		if err := json.Unmarshal(item.Content, &contents[n]); err != nil {
+			return nil, fmt.Errorf("item %s: %v", item.UUID, err)
+		}
+		if item.ContentType == "Tag" {
+			for _, ref := range contents[n].References {
+				tags[ref.UUID] = append(tags[ref.UUID], contents[n].Title)
+			}
+		}
+	}
+	for n, item := range backup.Items {
+		c := contents[n]
+		if item.ContentType != "Note" || item.Deleted || c.Trashed {
+			continue
+		}
+		files = append(files, importNote("standard notes "+item.UUID, c.Title, c.Text, tags[item.UUID],
+			jsonTime(item.CreatedAt)))
+	}
+	return files, nil
+}
+
+func jsonTime(s string) time.Time {
+	t, err := time.Parse(time.RFC3339Nano, s)
+	if err != nil {
+		return time.Now()
+	}
+	return t
+}
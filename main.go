@@ -4,12 +4,11 @@ import (
 	"bytes"
 	"crypto/sha256"
 	"database/sql"
-	"encoding/gob"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"image/color"
 	"log"
-	"net/http"
 	"os"
 	"path/filepath"
 	"runtime"
@@ -75,12 +74,36 @@ var (
 
 	authUsernameEditor widget.Editor
 	authPasswordEditor widget.Editor
+	authRememberCheck  widget.Bool
 	authButtonClick    widget.Clickable
+	authInviteEditor   widget.Editor
+	authSignupClick    widget.Clickable
+	authMessage        string
 	searchEditor       widget.Editor
 	searchList         widget.List
 	searchClicks       []widget.Clickable
 	newNoteClick       widget.Clickable
+	syncStatusClick    widget.Clickable
 	noteEditor         widget.Editor
+	noteImagesList     widget.List
+	noteAttachEditor   widget.Editor
+	noteAttachClick    widget.Clickable
+	noteAttachResult   string
+
+	settingsClick        widget.Clickable
+	settingsDevices      []Device
+	settingsError        string
+	settingsUsage        string
+	settingsRevokeClicks []widget.Clickable
+	settingsExportClick  widget.Clickable
+	settingsExportResult string
+	settingsBackupClick  widget.Clickable
+	settingsImportEditor widget.Editor
+	settingsImportClick  widget.Clickable
+	settingsPreviewClick widget.Clickable
+	settingsImportResult string
+	settingsAPICheck     widget.Bool
+	settingsAPIResult    string
 )
 
 func fonts() []text.FontFace {
@@ -99,6 +122,14 @@ func fonts() []text.FontFace {
 }
 
 func main() {
+	if len(os.Args) > 1 && commands[os.Args[1]] != nil {
+		if err := commands[os.Args[1]](os.Args[2:]); err != nil {
+			fmt.Fprintln(os.Stderr, "error:", err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	// init ui state
 	var options = []app.Option{app.Title("nervos"), app.NavigationColor(colorBg),
 		app.Size(dp(1200), dp(768)), app.MinSize(dp(360), dp(360))}
@@ -112,12 +143,16 @@ func main() {
 	page = "loading"
 	authUsernameEditor.Submit = true
 	authUsernameEditor.SingleLine = true
+	authInviteEditor.SingleLine = true
 	authPasswordEditor.Submit = true
 	authPasswordEditor.SingleLine = true
 	authPasswordEditor.Mask = '*'
 	searchList.Axis = layout.Vertical
 	searchEditor.Submit = true
 	searchEditor.SingleLine = true
+	settingsImportEditor.SingleLine = true
+	noteAttachEditor.SingleLine = true
+	noteAttachEditor.Submit = true
 	noteEditor.InputHint = key.HintText
 
 	defer func() {
@@ -128,19 +163,14 @@ func main() {
 
 	go func() {
 		// load initial data
-		dataDir, err := app.DataDir()
-		//dataDir, err := os.UserHomeDir()
+		dir, err := dataDir()
 		check(err)
-		if runtime.GOOS == "ios" {
-			dataDir, err = os.UserHomeDir()
-			check(err)
-			dataDir = filepath.Join(dataDir, "Documents")
-		}
-		log.Println("data dir:", dataDir)
-		check(dbInit(filepath.Join(dataDir, "nervos.db")))
+		log.Println("data dir:", dir)
+		check(dbInit(filepath.Join(dir, "nervos.db")))
 		settings, err = settingsLoad()
 		log.Println("settings:", settings)
 		check(err)
+		authRememberCheck.Value = settings.RememberUsername
 		if settings.Username == "" {
 			page = "login"
 			authUsernameEditor.Focus()
@@ -150,19 +180,27 @@ func main() {
 		}
 		win.Invalidate()
 
-		// sync
+		// sync, polling less often while the server pushes us events
+		go syncListen()
 		for {
 			if win == nil {
 				return
 			}
-			if len(dataKey) == 0 {
+			// logged out, the keys stay until the next login replaces them
+			if len(dataKey) == 0 || page == "unlock" || page == "login" {
 				time.Sleep(1 * time.Second)
 				continue
 			}
-			if err := syncChanges(); err != nil {
-				log.Println("error syncing:", err)
+			wait := syncRun()
+			layoutLock.Lock()
+			if syncListening && wait == syncInterval {
+				wait = 5 * time.Minute
+			}
+			layoutLock.Unlock()
+			select {
+			case <-syncNow:
+			case <-time.After(wait):
 			}
-			time.Sleep(30 * time.Second)
 		}
 	}()
 
@@ -199,65 +237,12 @@ func main() {
 	app.Main()
 }
 
-func syncChanges() error {
-	changes := []Item{}
-	for _, i := range items {
-		if i.Rev > settings.LastSync {
-			changes = append(changes, *i)
-		}
-	}
-	var bs bytes.Buffer
-	var err error
-	var req *http.Request
-	var res *http.Response
-	var updates []Item
-	err = gob.NewEncoder(&bs).Encode(changes)
-	if err != nil {
-		return err
-	}
-	req, err = http.NewRequest("POST", apiUrl, &bs)
-	if err != nil {
-		return err
-	}
-	req.Header.Set("userhash", userHash)
-	req.Header.Set("passkey", hex.EncodeToString(authKey))
-	req.Header.Set("checkpoint", strconv.FormatInt(settings.LastSync, 10))
-	res, err = http.DefaultClient.Do(req)
-	if err != nil {
-		return err
-	}
-	if res.StatusCode != 200 {
-		err = fmt.Errorf("non 200 status code: %d", res.StatusCode)
-		return err
-	}
-	err = gob.NewDecoder(res.Body).Decode(&updates)
-	if err != nil {
-		return err
-	}
-	for _, remotei := range updates {
-		if locali, ok := items[remotei.ID]; ok {
-			if remotei.Rev > locali.Rev {
-				var ii = remotei
-				items[ii.ID] = &ii
-				itemsSave(dataKey, &ii)
-				if page == "note" && pageSubject.(*Item).ID == ii.ID {
-					noteEditor.SetText(ii.Data)
-				}
-			}
-		} else {
-			var ii = remotei
-			items[ii.ID] = &ii
-			itemsSave(dataKey, &ii)
-		}
-	}
-	settings.LastSync, err = strconv.ParseInt(res.Header.Get("checkpoint"), 10, 64)
-	if err != nil {
-		return err
+func dataDir() (string, error) {
+	if runtime.GOOS == "ios" {
+		dir, err := os.UserHomeDir()
+		return filepath.Join(dir, "Documents"), err
 	}
-	settingsSave(settings)
-
-	log.Printf("synced %d changes, %d updates", len(changes), len(updates))
-	return nil
+	return app.DataDir()
 }
 
 func loop() {
@@ -274,6 +259,7 @@ func loop() {
 		switch e := e.(type) {
 		case system.DestroyEvent:
 			win = nil
+			apiStop()
 			if db != nil {
 				db.Close()
 			}
@@ -297,6 +283,9 @@ func layoutApp(g C) {
 	if authButtonClick.Clicked() {
 		updateLoginOrUnlock()
 	}
+	if authSignupClick.Clicked() {
+		updateLogin(true)
+	}
 	for _, e := range append(authUsernameEditor.Events(), authPasswordEditor.Events()...) {
 		if _, ok := e.(widget.SubmitEvent); ok {
 			updateLoginOrUnlock()
@@ -305,6 +294,32 @@ func layoutApp(g C) {
 	if newNoteClick.Clicked() {
 		updateNoteNew()
 	}
+	if settingsClick.Clicked() {
+		updateGoToSettings()
+	}
+	if syncStatusClick.Clicked() {
+		syncLater()
+	}
+	if settingsExportClick.Clicked() {
+		go updateExport()
+	}
+	if settingsBackupClick.Clicked() {
+		go updateBackup()
+	}
+	if settingsAPICheck.Changed() {
+		go updateLocalAPI(settingsAPICheck.Value)
+	}
+	if settingsImportClick.Clicked() {
+		go updateImport(settingsImportEditor.Text(), false)
+	}
+	if settingsPreviewClick.Clicked() {
+		go updateImport(settingsImportEditor.Text(), true)
+	}
+	for i := range settingsRevokeClicks {
+		if settingsRevokeClicks[i].Clicked() {
+			go updateSettingsDevices(settingsDevices[i].ID)
+		}
+	}
 	for _, e := range searchEditor.Events() {
 		if _, ok := e.(widget.SubmitEvent); ok {
 			if len(searchResults) > 0 {
@@ -329,6 +344,14 @@ func layoutApp(g C) {
 			updateNoteSave()
 		}
 	}
+	for _, e := range noteAttachEditor.Events() {
+		if _, ok := e.(widget.SubmitEvent); ok {
+			go updateAttach(noteAttachEditor.Text())
+		}
+	}
+	if noteAttachClick.Clicked() {
+		go updateAttach(noteAttachEditor.Text())
+	}
 
 	layoutLock.Lock()
 	defer layoutLock.Unlock()
@@ -352,6 +375,9 @@ func layoutApp(g C) {
 	if page == "note" {
 		layoutNote(g)
 	}
+	if page == "settings" {
+		layoutSettings(g)
+	}
 }
 
 func layoutLoading(g C) {
@@ -372,6 +398,12 @@ func layoutLogin(g C) {
 				return layout.Flex{Axis: layout.Vertical}.Layout(g,
 					layout.Rigid(layoutHeader(th, "Login")),
 					layout.Rigid(layout.Spacer{Height: dp(16)}.Layout),
+					layout.Rigid(func(g C) D {
+						if authMessage == "" {
+							return D{}
+						}
+						return layout.Inset{Bottom: dp(16)}.Layout(g, material.Body2(th, authMessage).Layout)
+					}),
 					layout.Rigid(layoutLabel(th, dp(14), "Username")),
 					layout.Rigid(layout.Spacer{Height: dp(4)}.Layout),
 					layout.Rigid(layoutInput(th, &authUsernameEditor, "")),
@@ -379,8 +411,16 @@ func layoutLogin(g C) {
 					layout.Rigid(layoutLabel(th, dp(14), "Password")),
 					layout.Rigid(layout.Spacer{Height: dp(4)}.Layout),
 					layout.Rigid(layoutInput(th, &authPasswordEditor, "")),
+					layout.Rigid(layout.Spacer{Height: dp(8)}.Layout),
+					layout.Rigid(material.CheckBox(th, &authRememberCheck, "Remember username on this device").Layout),
 					layout.Rigid(layout.Spacer{Height: dp(16)}.Layout),
 					layout.Rigid(layoutButton(th, &authButtonClick, "Login")),
+					layout.Rigid(layout.Spacer{Height: dp(24)}.Layout),
+					layout.Rigid(layoutLabel(th, dp(14), "New here? Pick a username and password above")),
+					layout.Rigid(layout.Spacer{Height: dp(4)}.Layout),
+					layout.Rigid(layoutInput(th, &authInviteEditor, "Invite, if the server needs one")),
+					layout.Rigid(layout.Spacer{Height: dp(8)}.Layout),
+					layout.Rigid(layoutButton(th, &authSignupClick, "Create account")),
 					layout.Rigid(layout.Spacer{Height: dp(16)}.Layout))
 			})
 		}))
@@ -394,6 +434,12 @@ func layoutUnlock(g C) {
 				return layout.Flex{Axis: layout.Vertical}.Layout(g,
 					layout.Rigid(layoutHeader(th, "Unlock")),
 					layout.Rigid(layout.Spacer{Height: dp(16)}.Layout),
+					layout.Rigid(func(g C) D {
+						if authMessage == "" {
+							return D{}
+						}
+						return layout.Inset{Bottom: dp(16)}.Layout(g, material.Body2(th, authMessage).Layout)
+					}),
 					layout.Rigid(layoutLabel(th, dp(14), "Password")),
 					layout.Rigid(layout.Spacer{Height: dp(4)}.Layout),
 					layout.Rigid(layoutInput(th, &authPasswordEditor, "")),
@@ -411,6 +457,12 @@ func layoutSearch(g C) {
 		Spacing:   layout.SpaceEnd,
 	}.Layout(g,
 		layout.Rigid(layoutSearchBar),
+		layout.Rigid(func(g C) D {
+			if syncProgress == "" {
+				return D{}
+			}
+			return layoutPageContent(dp(16), layoutLabel(th, dp(14), syncProgress))(g)
+		}),
 		layout.Rigid(layoutPageContent(dp(16), func(g C) D {
 			return material.List(th, &searchList).Layout(g, len(searchResults), func(g C, i int) D {
 				item := searchResults[i]
@@ -447,11 +499,65 @@ func layoutNote(g C) {
 		layout.Rigid(layoutSearchBar),
 		layout.Rigid(layoutPageContent(dp(16), func(g C) D {
 			g.Constraints.Min.Y = g.Metric.Px(dp(300))
-			return material.Editor(th, &noteEditor, "Note").Layout(g)
+			return layout.Flex{Axis: layout.Vertical}.Layout(g,
+				layout.Flexed(1, material.Editor(th, &noteEditor, "Note").Layout),
+				layout.Rigid(layoutNoteImages),
+				layout.Rigid(layout.Spacer{Height: dp(8)}.Layout),
+				layout.Rigid(func(g C) D {
+					return layout.Flex{Alignment: layout.Middle}.Layout(g,
+						layout.Flexed(1, layoutInput(th, &noteAttachEditor, "Path of an image or file to attach")),
+						layout.Rigid(func(g C) D {
+							b := material.Button(th, &noteAttachClick, "Attach")
+							b.CornerRadius = dp(0)
+							return b.Layout(g)
+						}))
+				}),
+				layout.Rigid(layoutLabel(th, dp(16), noteAttachResult)))
 		})))
 }
 
+// layoutNoteImages shows the images attached to the note in a row
+func layoutNoteImages(g C) D {
+	refs := [][]string{}
+	for _, m := range attachmentRe.FindAllStringSubmatch(noteEditor.Text(), -1) {
+		if m[1] == "!" {
+			refs = append(refs, m)
+		}
+	}
+	if len(refs) == 0 {
+		return D{}
+	}
+	return material.List(th, &noteImagesList).Layout(g, len(refs), func(g C, n int) D {
+		img := attachmentImageFor(refs[n][3])
+		return layout.Inset{Top: dp(8), Right: dp(8)}.Layout(g, func(g C) D {
+			if img.loading {
+				return layoutLabel(th, dp(14), "…")(g)
+			} else if img.err != nil {
+				return layoutLabel(th, dp(14), refs[n][2]+": "+img.err.Error())(g)
+			}
+			g.Constraints.Max.Y = g.Metric.Px(dp(200))
+			g.Constraints.Max.X = g.Metric.Px(dp(320))
+			return widget.Image{Src: img.op, Fit: widget.ScaleDown, Position: layout.NW}.Layout(g)
+		})
+	})
+}
+
+// layoutSearchBar also describes the sync status under the bar while its
+// indicator is hovered
 func layoutSearchBar(g C) D {
+	return layout.Flex{Axis: layout.Vertical}.Layout(g,
+		layout.Rigid(layoutSearchBarButtons),
+		layout.Rigid(func(g C) D {
+			if !syncStatusClick.Hovered() {
+				return D{}
+			}
+			return layoutWithBg(colorBgDark, layoutPageContent(dp(8), func(g C) D {
+				return layout.Inset{Left: dp(8)}.Layout(g, layoutLabel(th, dp(14), syncStatusText()))
+			}))(g)
+		}))
+}
+
+func layoutSearchBarButtons(g C) D {
 	g.Constraints.Max.Y = g.Metric.Px(dp(52))
 	return layoutWithBg(colorBg, layoutPageContent(dp(0), func(g C) D {
 		return layout.Inset{Right: dp(24)}.Layout(g, func(g C) D {
@@ -465,20 +571,108 @@ func layoutSearchBar(g C) D {
 					})
 				}),
 				layout.Rigid(func(g C) D {
-					g.Constraints.Min.X = g.Metric.Px(dp(52))
-					g.Constraints.Max.X = g.Metric.Px(dp(52))
-					b := material.Button(th, &newNoteClick, "+")
-					b.Color = colorBlack
-					b.Background = colorBgDark
-					b.CornerRadius = dp(0)
-					b.TextSize = dp(28)
-					b.Inset.Top = dp(6)
-					return b.Layout(g)
+					return layout.Flex{}.Layout(g,
+						layout.Rigid(layoutBarButton(th, &syncStatusClick, syncStatusGlyph())),
+						layout.Rigid(layoutBarButton(th, &settingsClick, "…")),
+						layout.Rigid(layoutBarButton(th, &newNoteClick, "+")))
 				}))
 		})
 	}))(g)
 }
 
+func layoutSettings(g C) {
+	layout.Flex{
+		WeightSum: float32(g.Constraints.Max.Y),
+		Axis:      layout.Vertical,
+		Spacing:   layout.SpaceEnd,
+	}.Layout(g,
+		layout.Rigid(layoutSearchBar),
+		layout.Rigid(layoutPageContent(dp(16), func(g C) D {
+			children := []layout.FlexChild{
+				layout.Rigid(layoutHeader(th, "Settings")),
+				layout.Rigid(layout.Spacer{Height: dp(16)}.Layout),
+				layout.Rigid(layoutLabelBold(th, dp(16), "Devices")),
+				layout.Rigid(layout.Spacer{Height: dp(8)}.Layout),
+			}
+			if settingsError != "" {
+				children = append(children, layout.Rigid(layoutLabel(th, dp(16), "ERROR: "+settingsError)))
+			} else if settingsDevices == nil {
+				children = append(children, layout.Rigid(layoutLabel(th, dp(16), "Loading...")))
+			}
+			for i := range settingsDevices {
+				d := settingsDevices[i]
+				click := &settingsRevokeClicks[i]
+				name := d.Name
+				if d.ID == settings.DeviceID {
+					name += " (this device)"
+				}
+				seen := "last seen " + time.Unix(d.LastSeen, 0).Format("2006-01-02 15:04 ")
+				children = append(children, layout.Rigid(func(g C) D {
+					return layout.Inset{Top: dp(4), Bottom: dp(4)}.Layout(g, func(g C) D {
+						return layout.Flex{Alignment: layout.Middle}.Layout(g,
+							layout.Flexed(1, layoutLabel(th, dp(16), name)),
+							layout.Rigid(layoutLabel(th, dp(16), seen)),
+							layout.Rigid(func(g C) D {
+								if d.Revoked {
+									return layoutLabel(th, dp(16), "revoked")(g)
+								}
+								b := material.Button(th, click, "Revoke")
+								b.CornerRadius = dp(0)
+								return b.Layout(g)
+							}))
+					})
+				}))
+			}
+			children = append(children,
+				layout.Rigid(layout.Spacer{Height: dp(16)}.Layout),
+				layout.Rigid(layoutLabelBold(th, dp(16), "Storage")),
+				layout.Rigid(layout.Spacer{Height: dp(8)}.Layout),
+				layout.Rigid(layoutLabel(th, dp(16), settingsUsage)),
+				layout.Rigid(layout.Spacer{Height: dp(16)}.Layout),
+				layout.Rigid(layoutLabelBold(th, dp(16), "Export")),
+				layout.Rigid(layout.Spacer{Height: dp(8)}.Layout),
+				layout.Rigid(func(g C) D {
+					return layout.Flex{Alignment: layout.Middle}.Layout(g,
+						layout.Flexed(1, layoutLabel(th, dp(16), settingsExportResult)),
+						layout.Rigid(func(g C) D {
+							b := material.Button(th, &settingsExportClick, "Export to markdown")
+							b.CornerRadius = dp(0)
+							return b.Layout(g)
+						}),
+						layout.Rigid(func(g C) D {
+							b := material.Button(th, &settingsBackupClick, "Back up")
+							b.CornerRadius = dp(0)
+							return b.Layout(g)
+						}))
+				}),
+				layout.Rigid(layout.Spacer{Height: dp(16)}.Layout),
+				layout.Rigid(layoutLabelBold(th, dp(16), "Import")),
+				layout.Rigid(layout.Spacer{Height: dp(8)}.Layout),
+				layout.Rigid(func(g C) D {
+					return layout.Flex{Alignment: layout.Middle}.Layout(g,
+						layout.Flexed(1, layoutInput(th, &settingsImportEditor, "Markdown folder, obsidian vault, .enex, .json or .nervosbak backup")),
+						layout.Rigid(func(g C) D {
+							b := material.Button(th, &settingsPreviewClick, "Preview")
+							b.CornerRadius = dp(0)
+							return b.Layout(g)
+						}),
+						layout.Rigid(func(g C) D {
+							b := material.Button(th, &settingsImportClick, "Import")
+							b.CornerRadius = dp(0)
+							return b.Layout(g)
+						}))
+				}),
+				layout.Rigid(layout.Spacer{Height: dp(8)}.Layout),
+				layout.Rigid(layoutLabel(th, dp(16), settingsImportResult)),
+				layout.Rigid(layout.Spacer{Height: dp(16)}.Layout),
+				layout.Rigid(layoutLabelBold(th, dp(16), "Local API")),
+				layout.Rigid(layout.Spacer{Height: dp(8)}.Layout),
+				layout.Rigid(material.CheckBox(th, &settingsAPICheck, "Let editor plugins and scripts on this computer use my notes while unlocked").Layout),
+				layout.Rigid(layoutLabel(th, dp(16), settingsAPIResult)))
+			return layout.Flex{Axis: layout.Vertical}.Layout(g, children...)
+		})))
+}
+
 func updateKey(e key.Event) {
 	if e.Name == key.NameTab && authUsernameEditor.Focused() {
 		authPasswordEditor.Focus()
@@ -499,6 +693,19 @@ func updateKey(e key.Event) {
 	if e.Name == "N" && e.Modifiers.Contain(key.ModCommand) {
 		updateNoteNew()
 	}
+	if e.Name == "," && e.Modifiers.Contain(key.ModCommand) {
+		updateGoToSettings()
+	}
+	if e.Name == "R" && e.Modifiers.Contain(key.ModCommand) {
+		syncLater()
+	}
+}
+
+// invalidate redraws the window, there is none when running a command
+func invalidate() {
+	if win != nil {
+		win.Invalidate()
+	}
 }
 
 func updateError(message string) {
@@ -507,74 +714,189 @@ func updateError(message string) {
 	win.Invalidate()
 }
 
+// updateLock sends the user back to the unlock page after the server refused
+// our login, syncing stops until they unlock again
+func updateLock(message string) {
+	updateLockOn("unlock", message)
+}
+
+// updateLogout locks the app on the login page, for when the server doesn't
+// know our account, which only the login page can create
+func updateLogout(message string) {
+	updateLockOn("login", message)
+}
+
+func updateLockOn(to, message string) {
+	layoutLock.Lock()
+	defer layoutLock.Unlock()
+	sessionToken = ""
+	apiStop()
+	attachmentImages = map[string]*attachmentImage{}
+	authMessage = message
+	authUsernameEditor.SetText(settings.Username)
+	page = to
+	authPasswordEditor.Focus()
+	win.Invalidate()
+}
+
 func updateLoginOrUnlock() {
 	if page == "login" {
-		updateLogin()
+		updateLogin(false)
 	}
 	if page == "unlock" {
 		updateUnlock()
 	}
 }
 
-func updateLogin() {
-	settings.Username = authUsernameEditor.Text()
-	updateUnlock()
+// updateLogin checks with the server that the account exists, creating it
+// first with signup, so a mistyped username doesn't open an empty vault. When
+// the server can't be reached the first sync tells instead, but for a signup,
+// as the account doesn't exist until the server says so.
+func updateLogin(signup bool) {
+	if authMessage == "Logging in..." {
+		return
+	}
+	settings.Username = strings.TrimSpace(authUsernameEditor.Text())
+	settings.RememberUsername = authRememberCheck.Value
+	password := []byte(authPasswordEditor.Text())
+	invite := strings.TrimSpace(authInviteEditor.Text())
+	if settings.Username == "" || len(password) == 0 {
+		authMessage = "enter a username and a password"
+		return
+	}
+	authMessage = "Logging in..."
+
+	go func() {
+		deriveKeys(password)
+		if settings.DeviceID == "" {
+			settings.DeviceID = uuid()
+		}
+		var err error
+		if signup {
+			err = syncSignup(invite)
+		} else {
+			err = syncLogin()
+		}
+		layoutLock.Lock()
+		defer layoutLock.Unlock()
+		if err != nil && (signup || syncErrorKind(err) != "network") {
+			authMessage = err.Error()
+			win.Invalidate()
+			return
+		} else if err != nil {
+			log.Println("login: server unreachable, checking the account on the next sync:", err)
+		}
+		authMessage = ""
+		authInviteEditor.SetText("")
+		updateUnlock()
+	}()
 }
 
 func updateUnlock() {
 	password := []byte(authPasswordEditor.Text())
 	authPasswordEditor.SetText("")
+	back := page
 
 	go func() {
-		userHashBs := sha256.Sum256([]byte(settings.Username))
-		userHash = hex.EncodeToString(userHashBs[:])
-		authKey = pbkdf2.Key(password, []byte("auth:"+userHash), 100000, 32, sha256.New)
-		dataKey = pbkdf2.Key(password, []byte("data:"+userHash), 100000, 32, sha256.New)
-
-		if len(settings.PasswordCheck) == 0 {
-			settings.PasswordCheck = textEncrypt(dataKey, userHash)
-			settingsSave(settings)
-		} else {
-			if bytes.Compare(settings.PasswordCheck, textEncrypt(dataKey, userHash)) != 0 {
-				updateError("wrong password")
-				go func() {
-					time.Sleep(600 * time.Millisecond)
-					page = "unlock"
-					authPasswordEditor.Focus()
-					win.Invalidate()
-				}()
-				return
-			}
-		}
-
-		var err error
-		allItems, err := itemsLoad(dataKey)
-		if err != nil {
+		err := unlockData(password)
+		if err == errWrongPassword {
+			updateError("wrong password")
+			go func() {
+				time.Sleep(600 * time.Millisecond)
+				page = back
+				authPasswordEditor.Focus()
+				win.Invalidate()
+			}()
+			return
+		} else if err != nil {
 			updateError(err.Error())
 			return
 		}
-		items = map[int64]*Item{}
-		for _, i := range allItems {
-			if i.Data == "" {
-				continue
+		authMessage = ""
+		if settings.LocalAPI {
+			if err := apiStart(); err != nil {
+				log.Println("local api:", err)
 			}
-			items[i.ID] = i
 		}
 		updateGoToSearch()
 	}()
 }
 
+var errWrongPassword = errors.New("wrong password")
+
+// deriveKeys derives userHash, authKey and dataKey from settings.Username
+// and password
+func deriveKeys(password []byte) {
+	userHashBs := sha256.Sum256([]byte(settings.Username))
+	userHash = hex.EncodeToString(userHashBs[:])
+	authKey = pbkdf2.Key(password, []byte("auth:"+userHash), 100000, 32, sha256.New)
+	dataKey = pbkdf2.Key(password, []byte("data:"+userHash), 100000, 32, sha256.New)
+}
+
+// unlockData derives our keys, checks the password, migrates the data to the
+// latest format and loads the items
+func unlockData(password []byte) error {
+	deriveKeys(password)
+	passwordOk := len(settings.PasswordCheck) == 0
+	if !passwordOk && settings.Version < formatVerifier {
+		// legacy check, replaced by a verifier below
+		passwordOk = bytes.Equal(settings.PasswordCheck, textEncrypt(dataKey, userHash))
+	} else if !passwordOk {
+		passwordOk = passwordVerify(dataKey, settings.PasswordCheck)
+	}
+	if !passwordOk {
+		return errWrongPassword
+	}
+
+	if err := settingsUnseal(dataKey, settings); err != nil {
+		return err
+	}
+	if settings.Version < formatSealed {
+		if err := itemsMigrate(dataKey); err != nil {
+			return err
+		}
+		settings.Version = formatSealed
+	}
+	if settings.DeviceID == "" {
+		settings.DeviceID = uuid()
+	}
+	if settings.Version < formatVerifier || len(settings.PasswordCheck) == 0 {
+		settings.PasswordCheck = passwordVerifier(dataKey)
+	}
+	if settings.Version < formatVerifier {
+		settings.Version = formatVerifier
+	}
+	if err := settingsSave(dataKey, settings); err != nil {
+		return err
+	}
+
+	allItems, err := itemsLoad(dataKey)
+	if err != nil {
+		return err
+	}
+	// emptied notes are kept, they are how deletions reach other devices
+	items = map[int64]*Item{}
+	for _, i := range allItems {
+		items[i.ID] = i
+	}
+	return nil
+}
+
 func updateGoToSearch() {
 	layoutLock.Lock()
 	defer layoutLock.Unlock()
 	page = "search"
 	searchEditor.Focus()
+	updateSearchResults()
+	win.Invalidate()
+}
+
+// updateSearchResults refreshes the search results, layoutLock must be held
+func updateSearchResults() {
 	searchResults = []*Item{}
 	query := strings.ToLower(searchEditor.Text())
 	for _, i := range items {
-		if query == "" ||
-			strconv.FormatInt(i.ID, 10) == query ||
-			strings.Contains(strings.ToLower(i.Data), query) {
+		if searchMatch(i, query) {
 			searchResults = append(searchResults, i)
 		}
 	}
@@ -582,7 +904,14 @@ func updateGoToSearch() {
 		return searchResults[i].Rev > searchResults[j].Rev
 	})
 	searchClicks = make([]widget.Clickable, len(searchResults))
-	win.Invalidate()
+}
+
+// searchMatch tells if a note matches a lowercase query, its id or some of
+// its text, emptied notes never match
+func searchMatch(i *Item, query string) bool {
+	return i.Data != "" && (query == "" ||
+		strconv.FormatInt(i.ID, 10) == query ||
+		strings.Contains(strings.ToLower(i.Data), query))
 }
 
 func updateGoToNote(i *Item) {
@@ -592,12 +921,219 @@ func updateGoToNote(i *Item) {
 	searchEditor.SetText("")
 	page = "note"
 	pageSubject = i
+	noteAttachResult = ""
 	noteEditor.SetText(i.Data)
 	noteEditor.SetCaret(len(i.Data), len(i.Data))
 	noteEditor.Focus()
 	win.Invalidate()
 }
 
+func updateGoToSettings() {
+	if len(dataKey) == 0 {
+		return
+	}
+	layoutLock.Lock()
+	defer layoutLock.Unlock()
+	page = "settings"
+	settingsDevices = nil
+	settingsError = ""
+	settingsUsage = "Loading..."
+	settingsExportResult = ""
+	settingsImportResult = ""
+	settingsAPICheck.Value = settings.LocalAPI
+	settingsAPIResult = updateLocalAPIResult()
+	win.Invalidate()
+	go updateSettingsDevices("")
+	go updateSettingsUsage()
+}
+
+// updateLocalAPI turns the local api on or off, meant to be run in its own
+// goroutine
+func updateLocalAPI(on bool) {
+	var err error
+	if on {
+		err = apiStart()
+	} else {
+		apiStop()
+	}
+	layoutLock.Lock()
+	defer layoutLock.Unlock()
+	if err == nil {
+		settings.LocalAPI = on
+		err = settingsSave(dataKey, settings)
+	}
+	if err != nil {
+		settingsAPIResult = "ERROR: " + err.Error()
+	} else {
+		settingsAPIResult = updateLocalAPIResult()
+	}
+	win.Invalidate()
+}
+
+func updateLocalAPIResult() string {
+	url := apiURL()
+	if url == "" {
+		return ""
+	}
+	path, _ := apiInfoPath()
+	return "Listening on " + url + ", the token is in " + path
+}
+
+// updateSettingsDevices fetches the device list, revoking a device first when
+// revoke is set, meant to be run in its own goroutine
+func updateSettingsDevices(revoke string) {
+	devices, err := syncDevices(revoke)
+	layoutLock.Lock()
+	defer layoutLock.Unlock()
+	if err != nil {
+		settingsError = err.Error()
+	} else {
+		settingsDevices = devices
+		settingsRevokeClicks = make([]widget.Clickable, len(devices))
+	}
+	win.Invalidate()
+}
+
+// updateSettingsUsage fetches what the account stores on the server, meant to
+// be run in its own goroutine
+func updateSettingsUsage() {
+	usage, err := syncUsage()
+	layoutLock.Lock()
+	defer layoutLock.Unlock()
+	if err != nil {
+		settingsUsage = "ERROR: " + err.Error()
+	} else {
+		count := func(n int64) string { return strconv.FormatInt(n, 10) }
+		settingsUsage = fmt.Sprintf("Notes: %s revisions, %s · Attachments: %d, %s",
+			formatUsage(usage.Items, usage.MaxItems, count), formatUsage(usage.Bytes, usage.MaxBytes, formatSize),
+			usage.Blobs, formatUsage(usage.BlobBytes, usage.MaxBlobBytes, formatSize))
+	}
+	win.Invalidate()
+}
+
+// updateExport exports all notes to exportDir, meant to be run in its own
+// goroutine
+func updateExport() {
+	dir, err := exportDir()
+	n := 0
+	if err == nil {
+		n, err = exportNotes(dir)
+	}
+	layoutLock.Lock()
+	defer layoutLock.Unlock()
+	if err != nil {
+		settingsExportResult = "ERROR: " + err.Error()
+	} else {
+		settingsExportResult = fmt.Sprintf("%d notes exported to %s", n, dir)
+	}
+	win.Invalidate()
+}
+
+// updateBackup backs up the notes with the vault key, meant to be run in its
+// own goroutine
+func updateBackup() {
+	path, err := backupPath()
+	n := 0
+	if err == nil {
+		n, err = backupWrite(path, nil)
+	}
+	layoutLock.Lock()
+	defer layoutLock.Unlock()
+	if err != nil {
+		settingsExportResult = "ERROR: " + err.Error()
+	} else {
+		settingsExportResult = fmt.Sprintf("%d notes backed up to %s", n, path)
+	}
+	win.Invalidate()
+}
+
+// updateImport imports the notes at path and syncs them, or only tells what
+// it would import on a dry run, meant to be run in its own goroutine
+func updateImport(path string, dryRun bool) {
+	path = strings.TrimSpace(path)
+	if strings.ToLower(filepath.Ext(path)) == ".nervosbak" {
+		updateRestore(path, dryRun)
+		return
+	}
+	layoutLock.Lock()
+	settingsImportResult = "Importing..."
+	layoutLock.Unlock()
+	win.Invalidate()
+	report, err := importNotes(path, dryRun)
+	for _, path := range report.Duplicates {
+		log.Println("import: duplicate:", path)
+	}
+	for _, link := range report.Unresolved {
+		log.Println("import: link not found:", link)
+	}
+	for _, e := range report.Errors {
+		log.Println("import: error:", e)
+	}
+	layoutLock.Lock()
+	defer layoutLock.Unlock()
+	settingsImportResult = report.String()
+	if dryRun {
+		settingsImportResult = "Would import: " + settingsImportResult
+	}
+	if err != nil {
+		settingsImportResult = "ERROR: " + err.Error()
+	} else if len(report.Errors) > 0 {
+		settingsImportResult += ", first: " + report.Errors[0]
+	}
+	syncLater()
+	win.Invalidate()
+}
+
+// updateRestore merges a backup sealed with the vault key into the notes,
+// backups sealed with a passphrase are restored from the terminal
+func updateRestore(path string, dryRun bool) {
+	layoutLock.Lock()
+	settingsImportResult = "Restoring..."
+	layoutLock.Unlock()
+	win.Invalidate()
+	backup, err := backupRead(path, nil)
+	n := 0
+	if err == nil {
+		n, err = backupRestore(backup, dryRun)
+	}
+	layoutLock.Lock()
+	defer layoutLock.Unlock()
+	if err != nil {
+		settingsImportResult = "ERROR: " + err.Error()
+	} else if dryRun {
+		settingsImportResult = fmt.Sprintf("Would restore %d of %d notes", n, len(backup.Items))
+	} else {
+		settingsImportResult = fmt.Sprintf("%d of %d notes restored", n, len(backup.Items))
+		if page == "search" {
+			updateSearchResults()
+		}
+	}
+	syncLater()
+	win.Invalidate()
+}
+
+// updateAttach attaches the file at path to the note being edited, where the
+// caret is, meant to be run in its own goroutine
+func updateAttach(path string) {
+	layoutLock.Lock()
+	noteAttachResult = "Attaching..."
+	layoutLock.Unlock()
+	invalidate()
+	md, err := attachmentAdd(path)
+	layoutLock.Lock()
+	defer layoutLock.Unlock()
+	noteAttachResult = ""
+	if err != nil {
+		noteAttachResult = "ERROR: " + err.Error()
+	} else if page == "note" {
+		noteEditor.Insert(md)
+		noteAttachEditor.SetText("")
+		updateNoteSave()
+		syncLater()
+	}
+	invalidate()
+}
+
 func updateNoteNew() {
 	item := &Item{}
 	item.ID = id()
@@ -664,6 +1200,20 @@ func layoutInput(th *material.Theme, e *widget.Editor, hint string) func(C) D {
 	}
 }
 
+func layoutBarButton(th *material.Theme, c *widget.Clickable, l string) func(C) D {
+	return func(g C) D {
+		g.Constraints.Min.X = g.Metric.Px(dp(52))
+		g.Constraints.Max.X = g.Metric.Px(dp(52))
+		b := material.Button(th, c, l)
+		b.Color = colorBlack
+		b.Background = colorBgDark
+		b.CornerRadius = dp(0)
+		b.TextSize = dp(28)
+		b.Inset.Top = dp(6)
+		return b.Layout(g)
+	}
+}
+
 func layoutButton(th *material.Theme, c *widget.Clickable, l string) func(C) D {
 	return func(gtx C) D {
 		gtx.Constraints.Min.X = gtx.Constraints.Max.X
@@ -0,0 +1,362 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"log"
+	"net/http"
+	"regexp"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+type LoginRequest struct {
+	UserHash    string `json:"userHash"`
+	A           []byte `json:"a"`
+	HandshakeID string `json:"handshakeId"`
+	Proof       []byte `json:"proof"`
+	DeviceID    string `json:"deviceId"`
+	DeviceName  string `json:"deviceName"`
+}
+
+type LoginResponse struct {
+	Enroll      bool   `json:"enroll"`
+	Legacy      bool   `json:"legacy"`
+	HandshakeID string `json:"handshakeId"`
+	Salt        []byte `json:"salt"`
+	B           []byte `json:"b"`
+	Proof       []byte `json:"proof"`
+	Token       string `json:"token"`
+	Expires     int64  `json:"expires"`
+}
+
+type EnrollRequest struct {
+	UserHash string `json:"userHash"`
+	PassKey  []byte `json:"passKey"`
+	Salt     []byte `json:"salt"`
+	Verifier []byte `json:"verifier"`
+}
+
+type SignupRequest struct {
+	UserHash string `json:"userHash"`
+	Salt     []byte `json:"salt"`
+	Verifier []byte `json:"verifier"`
+	Invite   string `json:"invite"`
+}
+
+type DevicesRequest struct {
+	Revoke string `json:"revoke"`
+}
+
+// Device is a client that logged in, holding at most one session token
+type Device struct {
+	ID        string `json:"id"`
+	Name      string `json:"name"`
+	TokenHash []byte `json:"-"`
+	Created   int64  `json:"created"`
+	LastSeen  int64  `json:"lastSeen"`
+	Expires   int64  `json:"expires"`
+	Revoked   bool   `json:"revoked"`
+}
+
+type handshake struct {
+	UserHash   string
+	DeviceID   string
+	DeviceName string
+	Server     *srpServer
+	Expires    time.Time
+}
+
+var deviceIDRe = regexp.MustCompile("^[a-zA-Z0-9-]{1,64}$")
+
+// registration is who can create an account, "open" to anyone, "invite" to
+// those with one of invites, each working once, or "closed" to no one
+var (
+	registration = "open"
+	invites      = map[string]bool{}
+)
+
+var handshakeTTL = time.Minute
+var sessionTTL = 30 * 24 * time.Hour
+
+var (
+	handshakesLock sync.Mutex
+	handshakes     = map[string]*handshake{}
+)
+
+// handleLogin runs the two steps of an srp handshake, the client first sends
+// UserHash, A and its device, then HandshakeID and its Proof, and gets a
+// session token for that device
+func handleLogin(w http.ResponseWriter, r *http.Request) {
+	defer handleErrors(w, r)
+	defer r.Body.Close()
+	req := LoginRequest{}
+	readBody(r, &req)
+	res := LoginResponse{}
+
+	if req.HandshakeID == "" {
+		if !userHashRe.MatchString(req.UserHash) {
+			panic(httpError{400, "invalid_userhash", "invalid userhash"})
+		}
+		if !deviceIDRe.MatchString(req.DeviceID) || len(req.DeviceName) > 64 {
+			panic(httpError{400, "invalid_device", "invalid device"})
+		}
+		metadata := Metadata{}
+		storeGetMetadata(req.UserHash, &metadata)
+		if metadata.UserHash == "" {
+			panic(httpError{404, "account_not_found", "account not found"})
+		} else if len(metadata.Verifier) == 0 {
+			res.Enroll = true
+			res.Legacy = len(metadata.PassHash) > 0
+			writeBody(w, r, res)
+			return
+		}
+		server := srpServerStart(metadata.Verifier, req.A)
+		if server == nil {
+			panic(httpError{400, "invalid_handshake", "invalid handshake"})
+		}
+		res.HandshakeID = randomToken()
+		res.Salt = metadata.Salt
+		res.B = server.B.Bytes()
+		handshakesLock.Lock()
+		handshakesCleanup()
+		handshakes[res.HandshakeID] = &handshake{req.UserHash, req.DeviceID, req.DeviceName,
+			server, time.Now().Add(handshakeTTL)}
+		handshakesLock.Unlock()
+		writeBody(w, r, res)
+		return
+	}
+
+	handshakesLock.Lock()
+	h := handshakes[req.HandshakeID]
+	delete(handshakes, req.HandshakeID)
+	handshakesLock.Unlock()
+	if h == nil || time.Now().After(h.Expires) {
+		panic(httpError{401, "handshake_expired", "handshake expired"})
+	}
+	res.Proof = h.Server.verify(req.Proof)
+	if res.Proof == nil {
+		panic(httpError{401, "wrong_password", "wrong password"})
+	}
+
+	res.Token = randomToken()
+	tokenHash := sha256.Sum256([]byte(res.Token))
+	unlock := lockUser(h.UserHash)
+	defer unlock()
+	retryOnConflict(func() {
+		metadata := Metadata{}
+		storeGetMetadata(h.UserHash, &metadata)
+		now := time.Now()
+		var device *Device
+		for i := range metadata.Devices {
+			if metadata.Devices[i].ID == h.DeviceID {
+				device = &metadata.Devices[i]
+			}
+		}
+		if device == nil {
+			metadata.Devices = append(metadata.Devices, Device{ID: h.DeviceID, Created: now.Unix()})
+			device = &metadata.Devices[len(metadata.Devices)-1]
+		}
+		if device.Revoked {
+			// revoking ended its sessions, a device knowing the password
+			// registers again as it could under another id anyway
+			device.Revoked = false
+			device.Created = now.Unix()
+		}
+		res.Expires = now.Add(sessionTTL).Unix()
+		device.Name = h.DeviceName
+		device.TokenHash = tokenHash[:]
+		device.LastSeen = now.Unix()
+		device.Expires = res.Expires
+		storePutMetadata(&metadata)
+	})
+	log.Println("login", h.UserHash, h.DeviceID)
+	writeBody(w, r, res)
+}
+
+// handleSignup creates an account with its srp verifier, if the server takes
+// new accounts, a client then logs in as usual
+func handleSignup(w http.ResponseWriter, r *http.Request) {
+	defer handleErrors(w, r)
+	defer r.Body.Close()
+	req := SignupRequest{}
+	readBody(r, &req)
+	if !userHashRe.MatchString(req.UserHash) {
+		panic(httpError{400, "invalid_userhash", "invalid userhash"})
+	}
+	if len(req.Salt) == 0 || len(req.Verifier) == 0 {
+		panic(httpError{400, "invalid_verifier", "invalid verifier"})
+	}
+	if registration == "closed" {
+		panic(httpError{403, "registration_closed", "this server doesn't take new accounts"})
+	} else if registration == "invite" && req.Invite == "" {
+		panic(httpError{403, "invite_required", "an invite is required to create an account"})
+	} else if registration == "invite" && !invites[req.Invite] {
+		panic(httpError{403, "invalid_invite", "invalid invite"})
+	}
+
+	unlock := lockUser(req.UserHash)
+	defer unlock()
+	metadata := Metadata{}
+	storeGetMetadata(req.UserHash, &metadata)
+	if metadata.UserHash != "" {
+		panic(httpError{409, "account_exists", "account already exists"})
+	}
+	created := false
+	if registration == "invite" {
+		// invites are used up in the store so every server process sees it,
+		// and given back when the account can't be created after all
+		inviteHash := sha256.Sum256([]byte(req.Invite))
+		inviteKey := "_invites/" + hex.EncodeToString(inviteHash[:])
+		_, err := store.Put(inviteKey, []byte(req.UserHash), "")
+		if err == errConflict {
+			panic(httpError{403, "invalid_invite", "invite already used"})
+		}
+		check(err)
+		defer func() {
+			if !created {
+				store.Delete(inviteKey)
+			}
+		}()
+	}
+	metadata = Metadata{UserHash: req.UserHash, Chunks: []int64{0}, Counted: true,
+		Salt: req.Salt, Verifier: req.Verifier}
+	// created only if it still doesn't exist, see Store
+	func() {
+		defer func() {
+			if err := recover(); err == errConflict {
+				panic(httpError{409, "account_exists", "account already exists"})
+			} else if err != nil {
+				panic(err)
+			}
+		}()
+		storePutMetadata(&metadata)
+	}()
+	created = true
+	log.Println("signup", req.UserHash)
+	w.WriteHeader(204)
+}
+
+// handleEnroll stores the srp verifier for an account created before srp,
+// after checking the legacy passkey one last time
+func handleEnroll(w http.ResponseWriter, r *http.Request) {
+	defer handleErrors(w, r)
+	defer r.Body.Close()
+	req := EnrollRequest{}
+	readBody(r, &req)
+	if !userHashRe.MatchString(req.UserHash) {
+		panic(httpError{400, "invalid_userhash", "invalid userhash"})
+	}
+	if len(req.Salt) == 0 || len(req.Verifier) == 0 {
+		panic(httpError{400, "invalid_verifier", "invalid verifier"})
+	}
+
+	unlock := lockUser(req.UserHash)
+	defer unlock()
+	retryOnConflict(func() {
+		metadata := Metadata{}
+		storeGetMetadata(req.UserHash, &metadata)
+		if len(metadata.Verifier) > 0 {
+			panic(httpError{409, "already_enrolled", "already enrolled"})
+		}
+		if metadata.UserHash == "" {
+			panic(httpError{404, "account_not_found", "account not found"})
+		} else if err := bcrypt.CompareHashAndPassword(metadata.PassHash, req.PassKey); err != nil {
+			panic(httpError{401, "wrong_password", "wrong password"})
+		}
+		metadata.PassHash = nil
+		metadata.Salt = req.Salt
+		metadata.Verifier = req.Verifier
+		storePutMetadata(&metadata)
+	})
+	log.Println("enroll", req.UserHash)
+	w.WriteHeader(204)
+}
+
+// handleDevices lists the user's devices, after revoking one if asked to
+func handleDevices(w http.ResponseWriter, r *http.Request) {
+	defer handleErrors(w, r)
+	defer r.Body.Close()
+	req := DevicesRequest{}
+	readBody(r, &req)
+	userHash := r.Header.Get("userhash")
+	if !userHashRe.MatchString(userHash) {
+		panic(httpError{400, "invalid_userhash", "invalid userhash"})
+	}
+
+	unlock := lockUser(userHash)
+	defer unlock()
+	metadata := Metadata{}
+	retryOnConflict(func() {
+		metadata = Metadata{}
+		storeGetMetadata(userHash, &metadata)
+		authenticate(r, &metadata)
+		if req.Revoke != "" {
+			found := false
+			for i := range metadata.Devices {
+				if metadata.Devices[i].ID == req.Revoke {
+					metadata.Devices[i].Revoked = true
+					metadata.Devices[i].TokenHash = nil
+					found = true
+				}
+			}
+			if !found {
+				panic(httpError{404, "device_not_found", "device not found"})
+			}
+			storePutMetadata(&metadata)
+		}
+	})
+	if req.Revoke != "" {
+		log.Println("revoke", userHash, req.Revoke)
+	}
+
+	devices := []Device{}
+	for _, d := range metadata.Devices {
+		d.TokenHash = nil
+		devices = append(devices, d)
+	}
+	writeBody(w, r, devices)
+}
+
+// authenticate finds the device the request's session token was issued to,
+// noting when it was last seen, the user must be locked
+func authenticate(r *http.Request, metadata *Metadata) *Device {
+	tokenHash := sha256.Sum256([]byte(r.Header.Get("session")))
+	now := time.Now()
+	for i := range metadata.Devices {
+		d := &metadata.Devices[i]
+		if subtle.ConstantTimeCompare(d.TokenHash, tokenHash[:]) != 1 {
+			continue
+		}
+		if d.Revoked || now.Unix() > d.Expires {
+			break
+		}
+		if now.Sub(time.Unix(d.LastSeen, 0)) > time.Hour {
+			d.LastSeen = now.Unix()
+			storePutMetadata(metadata)
+		}
+		return d
+	}
+	panic(httpError{401, "invalid_session", "invalid session"})
+}
+
+// handshakesCleanup drops expired handshakes, handshakesLock must be held
+func handshakesCleanup() {
+	now := time.Now()
+	for id, h := range handshakes {
+		if now.After(h.Expires) {
+			delete(handshakes, id)
+		}
+	}
+}
+
+func randomToken() string {
+	bs := make([]byte, 32)
+	_, err := rand.Read(bs)
+	check(err)
+	return hex.EncodeToString(bs)
+}
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// srp_client_test.go is the app's srp_client.go, copied so the server still
+// builds on its own
+//go:generate cp ../srp_client.go srp_client_test.go
+
+func TestSRPClientCopy(t *testing.T) {
+	app, err := ioutil.ReadFile("../srp_client.go")
+	if os.IsNotExist(err) {
+		t.Skip("the app isn't next to the server")
+	} else if err != nil {
+		t.Fatal(err)
+	}
+	copied, err := ioutil.ReadFile("srp_client_test.go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(app, copied) {
+		t.Error("srp_client_test.go differs from the app's srp_client.go, run go generate")
+	}
+}
+
+// testServer serves the auth endpoints from a fresh memory store
+func testServer(t *testing.T) *httptest.Server {
+	t.Helper()
+	store = newMemoryStore()
+	mux := http.NewServeMux()
+	mux.HandleFunc("/signup", withProtocol(handleSignup))
+	mux.HandleFunc("/login", withProtocol(handleLogin))
+	mux.HandleFunc("/devices", withProtocol(handleDevices))
+	s := httptest.NewServer(mux)
+	t.Cleanup(s.Close)
+	return s
+}
+
+// testPost posts in to path, gob encoded like the app does, and decodes the
+// answer into out, returning the error code when the server sent one
+func testPost(t *testing.T, s *httptest.Server, path string, headers map[string]string, in, out interface{}) string {
+	t.Helper()
+	var body bytes.Buffer
+	if err := gob.NewEncoder(&body).Encode(in); err != nil {
+		t.Fatal(err)
+	}
+	req, err := http.NewRequest("POST", s.URL+path, &body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("protocol", strconv.Itoa(protocolVersion))
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode >= 300 {
+		e := struct{ Error string }{}
+		json.NewDecoder(res.Body).Decode(&e)
+		return e.Error
+	}
+	if out != nil {
+		if err := gob.NewDecoder(res.Body).Decode(out); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return ""
+}
+
+// testLogin runs both steps of the handshake with the app's srp client
+func testLogin(t *testing.T, s *httptest.Server, userHash string, secret []byte) (*srpClient, LoginResponse, string) {
+	t.Helper()
+	c := srpClientStart()
+	res := LoginResponse{}
+	req := LoginRequest{UserHash: userHash, A: c.A.Bytes(), DeviceID: "device", DeviceName: "test"}
+	if code := testPost(t, s, "/login", nil, req, &res); code != "" {
+		return c, res, code
+	}
+	proof, err := c.proof(res.Salt, secret, res.B)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req = LoginRequest{HandshakeID: res.HandshakeID, Proof: proof}
+	res = LoginResponse{}
+	return c, res, testPost(t, s, "/login", nil, req, &res)
+}
+
+func testSignup(t *testing.T, s *httptest.Server, userHash string, secret []byte) {
+	t.Helper()
+	salt := []byte("salt for " + userHash)
+	req := SignupRequest{UserHash: userHash, Salt: salt, Verifier: srpVerifier(salt, secret)}
+	if code := testPost(t, s, "/signup", nil, req, nil); code != "" {
+		t.Fatal("signup:", code)
+	}
+}
+
+func TestLogin(t *testing.T) {
+	s := testServer(t)
+	testSignup(t, s, "alice", []byte("alice's key"))
+
+	c, res, code := testLogin(t, s, "alice", []byte("alice's key"))
+	if code != "" {
+		t.Fatal("login:", code)
+	}
+	if !c.verify(res.Proof) {
+		t.Error("server proof doesn't verify")
+	}
+	if res.Token == "" || res.Expires <= time.Now().Unix() {
+		t.Errorf("invalid session %q expiring %d", res.Token, res.Expires)
+	}
+	devices := []Device{}
+	headers := map[string]string{"userhash": "alice", "session": res.Token}
+	if code := testPost(t, s, "/devices", headers, DevicesRequest{}, &devices); code != "" {
+		t.Fatal("devices:", code)
+	}
+	if len(devices) != 1 || devices[0].ID != "device" {
+		t.Errorf("unexpected devices %+v", devices)
+	}
+
+	stored := Metadata{}
+	storeGetMetadata("alice", &stored)
+	if bytes.Contains(stored.Verifier, []byte("alice's key")) || len(stored.PassHash) > 0 {
+		t.Error("the server holds a password equivalent")
+	}
+}
+
+func TestLoginAfterRevoked(t *testing.T) {
+	s := testServer(t)
+	testSignup(t, s, "alice", []byte("alice's key"))
+	_, res, code := testLogin(t, s, "alice", []byte("alice's key"))
+	if code != "" {
+		t.Fatal("login:", code)
+	}
+	headers := map[string]string{"userhash": "alice", "session": res.Token}
+	if code := testPost(t, s, "/devices", headers, DevicesRequest{Revoke: "device"}, nil); code != "" {
+		t.Fatal("revoke:", code)
+	}
+	if code := testPost(t, s, "/devices", headers, DevicesRequest{}, nil); code != "invalid_session" {
+		t.Errorf("expected invalid_session once revoked, got %q", code)
+	}
+
+	_, res, code = testLogin(t, s, "alice", []byte("alice's key"))
+	if code != "" {
+		t.Fatal("login after revoked:", code)
+	}
+	devices := []Device{}
+	headers["session"] = res.Token
+	if code := testPost(t, s, "/devices", headers, DevicesRequest{}, &devices); code != "" {
+		t.Fatal("devices:", code)
+	}
+	if len(devices) != 1 || devices[0].Revoked {
+		t.Errorf("expected the device registered again, got %+v", devices)
+	}
+}
+
+func TestLoginInvalidA(t *testing.T) {
+	s := testServer(t)
+	testSignup(t, s, "alice", []byte("alice's key"))
+	tooLarge := new(big.Int).Lsh(big.NewInt(1), 2048)
+	for _, A := range []*big.Int{big.NewInt(0), srpN, new(big.Int).Add(srpN, big.NewInt(2)), tooLarge} {
+		req := LoginRequest{UserHash: "alice", A: A.Bytes(), DeviceID: "device", DeviceName: "test"}
+		if code := testPost(t, s, "/login", nil, req, &LoginResponse{}); code != "invalid_handshake" {
+			t.Errorf("A of %d bits: expected invalid_handshake, got %q", A.BitLen(), code)
+		}
+	}
+}
+
+func TestLoginWrongPassword(t *testing.T) {
+	s := testServer(t)
+	testSignup(t, s, "alice", []byte("alice's key"))
+
+	_, res, code := testLogin(t, s, "alice", []byte("not alice's key"))
+	if code != "wrong_password" {
+		t.Errorf("expected wrong_password, got %q", code)
+	}
+	if res.Token != "" {
+		t.Error("got a session with the wrong password")
+	}
+	headers := map[string]string{"userhash": "alice", "session": ""}
+	if code := testPost(t, s, "/devices", headers, DevicesRequest{}, nil); code != "invalid_session" {
+		t.Errorf("expected invalid_session, got %q", code)
+	}
+	if _, _, code := testLogin(t, s, "bob", []byte("bob's key")); code != "account_not_found" {
+		t.Errorf("expected account_not_found, got %q", code)
+	}
+}
+
+func TestLoginHandshakeExpired(t *testing.T) {
+	defer func(ttl time.Duration) { handshakeTTL = ttl }(handshakeTTL)
+	s := testServer(t)
+	testSignup(t, s, "alice", []byte("alice's key"))
+
+	handshakeTTL = -time.Second
+	if _, _, code := testLogin(t, s, "alice", []byte("alice's key")); code != "handshake_expired" {
+		t.Errorf("expected handshake_expired, got %q", code)
+	}
+
+	// a handshake can't be answered twice either
+	handshakeTTL = time.Minute
+	c := srpClientStart()
+	res := LoginResponse{}
+	req := LoginRequest{UserHash: "alice", A: c.A.Bytes(), DeviceID: "device", DeviceName: "test"}
+	if code := testPost(t, s, "/login", nil, req, &res); code != "" {
+		t.Fatal("login:", code)
+	}
+	proof, err := c.proof(res.Salt, []byte("alice's key"), res.B)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req = LoginRequest{HandshakeID: res.HandshakeID, Proof: proof}
+	if code := testPost(t, s, "/login", nil, req, &LoginResponse{}); code != "" {
+		t.Fatal("login:", code)
+	}
+	if code := testPost(t, s, "/login", nil, req, &LoginResponse{}); code != "handshake_expired" {
+		t.Errorf("replayed handshake: expected handshake_expired, got %q", code)
+	}
+}
+
+// failingStore fails to write accounts' metadata, as when another server
+// process created the account first
+type failingStore struct{ Store }
+
+func (s failingStore) Put(key string, data []byte, version string) (string, error) {
+	if strings.HasSuffix(key, "/_meta") {
+		return "", errConflict
+	}
+	return s.Store.Put(key, data, version)
+}
+
+func TestSignupInviteGivenBack(t *testing.T) {
+	defer func(r string, i map[string]bool) { registration, invites = r, i }(registration, invites)
+	registration, invites = "invite", map[string]bool{"invite": true}
+	s := testServer(t)
+	req := SignupRequest{UserHash: "alice", Salt: []byte("salt"), Verifier: srpVerifier([]byte("salt"), []byte("alice's key")), Invite: "invite"}
+
+	store = failingStore{store}
+	if code := testPost(t, s, "/signup", nil, req, nil); code != "account_exists" {
+		t.Errorf("expected account_exists, got %q", code)
+	}
+	store = store.(failingStore).Store
+	if code := testPost(t, s, "/signup", nil, req, nil); code != "" {
+		t.Errorf("signing up with the invite given back: %q", code)
+	}
+	req.UserHash = "bob"
+	if code := testPost(t, s, "/signup", nil, req, nil); code != "invalid_invite" {
+		t.Errorf("expected invalid_invite, got %q", code)
+	}
+}
@@ -0,0 +1,398 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var blobIDRe = regexp.MustCompile(`^[0-9a-f]{64}$`)
+
+// maxBlobSize bounds attachments, larger than a request as they can be
+// uploaded in parts
+var maxBlobSize int64 = 64 << 20
+
+// blobGrace is how long a blob is kept even if no note refers to it, the
+// note may not have reached the device asking for a collection yet
+var blobGrace = 24 * time.Hour
+
+// Blob is a stored attachment, as recorded in Metadata. Blobs uploaded in
+// parts stay stored as those, Parts being their sizes, so no more than a part
+// is ever read at once.
+type Blob struct {
+	Size    int64
+	Created int64
+	Parts   []int64
+}
+
+// Upload is a blob being uploaded in parts, part n is stored under its
+// offset, the sum of the sizes of the parts before it
+type Upload struct {
+	Size    int64
+	Parts   []int64
+	Updated int64
+}
+
+func (u *Upload) received() int64 {
+	n := int64(0)
+	for _, p := range u.Parts {
+		n += p
+	}
+	return n
+}
+
+// uploadBytes is how much of the user's uploads in parts but id's the server
+// holds, they count towards the quota as much as finished blobs
+func (m *Metadata) uploadBytes(id string) int64 {
+	n := int64(0)
+	for uploadID, u := range m.Uploads {
+		if uploadID != id {
+			n += u.received()
+		}
+	}
+	return n
+}
+
+type BlobsRequest struct {
+	IDs []string `json:"ids"`
+}
+
+// BlobsResponse lists the blobs the server doesn't have, with how much of
+// them it received already when they're being uploaded in parts
+type BlobsResponse struct {
+	Missing []string         `json:"missing"`
+	Offsets map[string]int64 `json:"offsets"`
+}
+
+type BlobsCollectRequest struct {
+	Keep []string `json:"keep"`
+}
+
+type BlobsCollectResponse struct {
+	Deleted []string `json:"deleted"`
+	Bytes   int64    `json:"bytes"`
+}
+
+// handleBlobs stores and serves attachments, sealed by the clients, apart
+// from the items so notes stay small. Blobs are addressed by the sha256 of
+// their content, which is checked once uploaded, and never change.
+//
+//	POST /blobs {ids}  answers which of ids the server doesn't have
+//	PUT /blobs/<id>?offset=<n>&size=<size>  stores the body at offset n of
+//	                   the blob, all of it without parameters
+//	GET /blobs/<id>    answers a blob
+//	POST /blobs/gc {keep}  deletes the blobs not in keep, but recent ones
+//
+// The user is only locked once the request is authenticated and its body
+// read, so a slow upload doesn't hold up their syncs.
+func handleBlobs(w http.ResponseWriter, r *http.Request) {
+	defer handleErrors(w, r)
+	defer r.Body.Close()
+	userHash := r.Header.Get("userhash")
+	if !userHashRe.MatchString(userHash) {
+		panic(httpError{400, "invalid_userhash", "invalid userhash"})
+	}
+	metadata := Metadata{}
+	retryOnConflict(func() {
+		metadata = Metadata{}
+		storeGetMetadata(userHash, &metadata)
+		authenticate(r, &metadata)
+	})
+
+	id := strings.Trim(strings.TrimPrefix(r.URL.Path, "/blobs"), "/")
+	if id == "" && r.Method == "POST" {
+		req := BlobsRequest{}
+		readBody(r, &req)
+		writeBody(w, r, blobsMissing(userHash, req.IDs))
+		return
+	} else if id == "gc" && r.Method == "POST" {
+		req := BlobsCollectRequest{}
+		readBody(r, &req)
+		unlock := lockUser(userHash)
+		defer unlock()
+		writeBody(w, r, blobsCollect(userHash, req.Keep))
+		return
+	}
+	if !blobIDRe.MatchString(id) {
+		panic(httpError{400, "invalid_blob", "invalid blob id"})
+	}
+	switch r.Method {
+	case "GET":
+		b, ok := metadata.Blobs[id]
+		if !ok {
+			panic(httpError{404, "blob_not_found", "blob not found"})
+		}
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Content-Length", strconv.FormatInt(b.Size, 10))
+		blobRead(userHash, id, b, func(data []byte) {
+			w.Write(data)
+		})
+	case "PUT":
+		data, err := ioutil.ReadAll(r.Body)
+		if err != nil && err.Error() == "http: request body too large" {
+			panic(httpError{413, "body_too_large", fmt.Sprintf("requests can't be larger than %d bytes, upload larger blobs in parts", maxBodySize)})
+		}
+		check(err)
+		offset, size := int64(0), int64(len(data))
+		if r.URL.Query().Get("size") != "" {
+			offset, err = strconv.ParseInt(r.URL.Query().Get("offset"), 10, 64)
+			if err == nil {
+				size, err = strconv.ParseInt(r.URL.Query().Get("size"), 10, 64)
+			}
+			if err != nil || offset < 0 || offset+int64(len(data)) > size {
+				panic(httpError{400, "invalid_offset", "invalid offset or size"})
+			}
+		}
+		if size > maxBlobSize {
+			panic(httpError{413, "blob_too_large", fmt.Sprintf("blobs can't be larger than %d bytes", maxBlobSize)})
+		}
+		unlock := lockUser(userHash)
+		defer unlock()
+		blobPut(userHash, id, data, offset, size)
+		w.WriteHeader(204)
+	default:
+		panic(httpError{405, "method_not_allowed", "method not allowed"})
+	}
+}
+
+func blobKey(userHash, id string) string {
+	return userHash + "/blobs/" + id
+}
+
+func uploadKey(userHash, id string, offset int64) string {
+	return userHash + "/uploads/" + id + "/" + strconv.FormatInt(offset, 10)
+}
+
+// blobRead passes a blob to read a part at a time
+func blobRead(userHash, id string, b Blob, read func([]byte)) {
+	if len(b.Parts) == 0 {
+		data, _, err := store.Get(blobKey(userHash, id))
+		check(err)
+		read(data)
+		return
+	}
+	partsRead(userHash, id, b.Parts, read)
+}
+
+// partsRead passes the parts of an upload to read one at a time
+func partsRead(userHash, id string, parts []int64, read func([]byte)) {
+	at := int64(0)
+	for _, part := range parts {
+		data, _, err := store.Get(uploadKey(userHash, id, at))
+		check(err)
+		read(data)
+		at += part
+	}
+}
+
+// blobDelete deletes a blob's objects, once forgotten by the metadata
+func blobDelete(userHash, id string, b Blob) {
+	if len(b.Parts) == 0 {
+		check(store.Delete(blobKey(userHash, id)))
+	}
+	at := int64(0)
+	for _, part := range b.Parts {
+		check(store.Delete(uploadKey(userHash, id, at)))
+		at += part
+	}
+}
+
+func blobsMissing(userHash string, ids []string) BlobsResponse {
+	if len(ids) > maxItems {
+		panic(httpError{413, "too_many_items", fmt.Sprintf("at most %d blobs can be checked at once", maxItems)})
+	}
+	res := BlobsResponse{Missing: []string{}, Offsets: map[string]int64{}}
+	metadata := Metadata{}
+	storeGetMetadata(userHash, &metadata)
+	for _, id := range ids {
+		if _, ok := metadata.Blobs[id]; ok {
+			continue
+		}
+		res.Missing = append(res.Missing, id)
+		if u, ok := metadata.Uploads[id]; ok {
+			res.Offsets[id] = u.received()
+		}
+	}
+	return res
+}
+
+// blobPut stores part of a blob at offset, or all of it, and the blob once
+// all its parts are there, the user's lock must be held
+func blobPut(userHash, id string, data []byte, offset, size int64) {
+	blobsExpireUploads(userHash)
+	metadata := Metadata{}
+	exists := false
+	var u *Upload
+	retryOnConflict(func() {
+		metadata = Metadata{}
+		storeGetMetadata(userHash, &metadata)
+		_, exists = metadata.Blobs[id]
+		u = metadata.Uploads[id]
+	})
+	if exists {
+		// blobs never change, this one is the same
+		return
+	}
+	if quotaBlobBytes > 0 && metadata.BlobBytes+metadata.uploadBytes(id)+size > quotaBlobBytes {
+		panic(quotaError(fmt.Sprintf("%d bytes of attachments", quotaBlobBytes)))
+	}
+	if u == nil || u.Size != size {
+		u = &Upload{Size: size}
+	}
+	if offset != u.received() {
+		panic(httpError{409, "invalid_offset", fmt.Sprintf("expected offset %d", u.received())})
+	}
+
+	if offset+int64(len(data)) < size {
+		storeReplace(uploadKey(userHash, id, offset), data)
+		retryOnConflict(func() {
+			metadata = Metadata{}
+			storeGetMetadata(userHash, &metadata)
+			if metadata.Uploads == nil {
+				metadata.Uploads = map[string]*Upload{}
+			}
+			if current := metadata.Uploads[id]; current == nil || current.Size != size {
+				metadata.Uploads[id] = &Upload{Size: size}
+			}
+			if metadata.Uploads[id].received() != offset {
+				panic(httpError{409, "invalid_offset", fmt.Sprintf("expected offset %d", metadata.Uploads[id].received())})
+			}
+			metadata.Uploads[id].Parts = append(metadata.Uploads[id].Parts, int64(len(data)))
+			metadata.Uploads[id].Updated = time.Now().Unix()
+			storePutMetadata(&metadata)
+		})
+		return
+	}
+
+	// last part, or the whole blob, checked a part at a time
+	blob := Blob{Size: size, Created: time.Now().Unix()}
+	if offset > 0 {
+		blob.Parts = append(append([]int64{}, u.Parts...), int64(len(data)))
+	}
+	hash := sha256.New()
+	partsRead(userHash, id, u.Parts, func(part []byte) {
+		hash.Write(part)
+	})
+	hash.Write(data)
+	if hex.EncodeToString(hash.Sum(nil)) != id {
+		blobsDropUpload(userHash, id)
+		panic(httpError{400, "invalid_blob", "the blob doesn't match its id"})
+	}
+	if offset > 0 {
+		storeReplace(uploadKey(userHash, id, offset), data)
+	} else if _, err := store.Put(blobKey(userHash, id), data, ""); err != nil && err != errConflict {
+		check(err)
+	}
+	retryOnConflict(func() {
+		metadata = Metadata{}
+		storeGetMetadata(userHash, &metadata)
+		if _, ok := metadata.Blobs[id]; ok {
+			return
+		}
+		if metadata.Blobs == nil {
+			metadata.Blobs = map[string]Blob{}
+		}
+		// the parts are the blob's now
+		delete(metadata.Uploads, id)
+		metadata.Blobs[id] = blob
+		metadata.BlobBytes += blob.Size
+		storePutMetadata(&metadata)
+	})
+	log.Println("blob", userHash, id, blob.Size)
+}
+
+// blobsExpireUploads drops the uploads in parts no part was added to for
+// blobGrace, clients resume theirs sooner, the user's lock must be held
+func blobsExpireUploads(userHash string) {
+	metadata := Metadata{}
+	storeGetMetadata(userHash, &metadata)
+	before := time.Now().Add(-blobGrace).Unix()
+	for id, u := range metadata.Uploads {
+		if u.Updated < before {
+			blobsDropUpload(userHash, id)
+		}
+	}
+}
+
+// blobsDropUpload forgets an upload in parts and deletes its parts, the
+// user's lock must be held
+func blobsDropUpload(userHash, id string) {
+	var u *Upload
+	retryOnConflict(func() {
+		metadata := Metadata{}
+		storeGetMetadata(userHash, &metadata)
+		if u = metadata.Uploads[id]; u == nil {
+			return
+		}
+		delete(metadata.Uploads, id)
+		storePutMetadata(&metadata)
+	})
+	if u == nil {
+		return
+	}
+	at := int64(0)
+	for _, part := range u.Parts {
+		check(store.Delete(uploadKey(userHash, id, at)))
+		at += part
+	}
+}
+
+// blobsCollect deletes the blobs no note refers to anymore, which only the
+// clients can tell as they alone read the notes, and abandoned uploads.
+// Blobs uploaded recently are kept, a note referring to them may not have
+// reached the device asking yet. The user's lock must be held.
+func blobsCollect(userHash string, keep []string) BlobsCollectResponse {
+	kept := map[string]bool{}
+	for _, id := range keep {
+		kept[id] = true
+	}
+	res := BlobsCollectResponse{Deleted: []string{}}
+	deleted := map[string]Blob{}
+	retryOnConflict(func() {
+		res = BlobsCollectResponse{Deleted: []string{}}
+		deleted = map[string]Blob{}
+		metadata := Metadata{}
+		storeGetMetadata(userHash, &metadata)
+		before := time.Now().Add(-blobGrace).Unix()
+		for id, b := range metadata.Blobs {
+			if !kept[id] && b.Created < before {
+				res.Deleted = append(res.Deleted, id)
+				res.Bytes += b.Size
+				deleted[id] = b
+			}
+		}
+		if len(res.Deleted) == 0 {
+			return
+		}
+		for _, id := range res.Deleted {
+			delete(metadata.Blobs, id)
+		}
+		metadata.BlobBytes -= res.Bytes
+		storePutMetadata(&metadata)
+	})
+	// forgotten first, a blob without its objects would be worse than
+	// objects left behind
+	for id, b := range deleted {
+		blobDelete(userHash, id, b)
+	}
+	blobsExpireUploads(userHash)
+	log.Println("blobs collected", userHash, len(res.Deleted), res.Bytes)
+	return res
+}
+
+// storeReplace writes data to key whether or not something is there already
+func storeReplace(key string, data []byte) {
+	retryOnConflict(func() {
+		_, version, err := store.Get(key)
+		check(err)
+		_, err = store.Put(key, data, version)
+		check(err)
+	})
+}
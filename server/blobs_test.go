@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// testBlob sends a blob request for alice's device, returning the answer
+func testBlob(method, path string, body []byte) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, path, bytes.NewReader(body))
+	r.Header.Set("protocol", strconv.Itoa(protocolVersion))
+	r.Header.Set("userhash", "alice")
+	r.Header.Set("session", "token")
+	w := httptest.NewRecorder()
+	withProtocol(handleBlobs)(w, r)
+	return w
+}
+
+func testBlobID(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func TestBlobParts(t *testing.T) {
+	testAccount(t, "alice", "token")
+	blob := bytes.Repeat([]byte("attachment "), 100)
+	id := testBlobID(blob)
+	for offset := 0; offset < len(blob); offset += 300 {
+		part := blob[offset:min(offset+300, len(blob))]
+		path := fmt.Sprintf("/blobs/%s?offset=%d&size=%d", id, offset, len(blob))
+		if w := testBlob("PUT", path, part); w.Code != 204 {
+			t.Fatalf("part at %d: %d %s", offset, w.Code, w.Body.String())
+		}
+	}
+	w := testBlob("GET", "/blobs/"+id, nil)
+	if w.Code != 200 || !bytes.Equal(w.Body.Bytes(), blob) {
+		t.Errorf("got back %d, %d bytes, expected the %d uploaded", w.Code, w.Body.Len(), len(blob))
+	}
+	metadata := Metadata{}
+	storeGetMetadata("alice", &metadata)
+	if b := metadata.Blobs[id]; b.Size != int64(len(blob)) || len(b.Parts) != 4 || len(metadata.Uploads) != 0 {
+		t.Errorf("unexpected blob %+v, uploads %+v", b, metadata.Uploads)
+	}
+
+	// deleting it deletes its parts
+	metadata.Blobs[id] = Blob{Size: metadata.Blobs[id].Size, Parts: metadata.Blobs[id].Parts}
+	storePutMetadata(&metadata)
+	blobsCollect("alice", nil)
+	for key := range store.(*memoryStore).objects {
+		if key != "alice/_meta" {
+			t.Errorf("%s left behind", key)
+		}
+	}
+}
+
+func TestBlobUploadsQuota(t *testing.T) {
+	defer func(quota int64) { quotaBlobBytes = quota }(quotaBlobBytes)
+	quotaBlobBytes = 1000
+	testAccount(t, "alice", "token")
+
+	// uploads never finished take room too
+	first := bytes.Repeat([]byte("a"), 900)
+	path := fmt.Sprintf("/blobs/%s?offset=0&size=900", testBlobID(first))
+	if w := testBlob("PUT", path, first[:600]); w.Code != 204 {
+		t.Fatalf("first upload: %d %s", w.Code, w.Body.String())
+	}
+	second := bytes.Repeat([]byte("b"), 500)
+	path = fmt.Sprintf("/blobs/%s?offset=0&size=500", testBlobID(second))
+	if w := testBlob("PUT", path, second[:100]); w.Code != 507 {
+		t.Errorf("expected 507 with another upload pending, got %d", w.Code)
+	}
+
+	// until they expire
+	metadata := Metadata{}
+	storeGetMetadata("alice", &metadata)
+	for _, u := range metadata.Uploads {
+		u.Updated = time.Now().Add(-blobGrace - time.Minute).Unix()
+	}
+	storePutMetadata(&metadata)
+	if w := testBlob("PUT", "/blobs/"+testBlobID(second), second); w.Code != 204 {
+		t.Errorf("expected the expired upload dropped, got %d %s", w.Code, w.Body.String())
+	}
+	metadata = Metadata{}
+	storeGetMetadata("alice", &metadata)
+	if len(metadata.Uploads) != 0 || metadata.BlobBytes != 500 {
+		t.Errorf("unexpected uploads %+v, %d bytes", metadata.Uploads, metadata.BlobBytes)
+	}
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+type CompactResult struct {
+	Before int `json:"before"`
+	After  int `json:"after"`
+}
+
+// users that pushed changes since the last scheduled compaction
+var compactPending = struct {
+	sync.Mutex
+	m map[string]bool
+}{m: map[string]bool{}}
+
+// handleCompact compacts the authenticated user's chunks on demand
+func handleCompact(w http.ResponseWriter, r *http.Request) {
+	defer handleErrors(w, r)
+	defer r.Body.Close()
+	userHash := r.Header.Get("userhash")
+	if !userHashRe.MatchString(userHash) {
+		panic(httpError{400, "invalid_userhash", "invalid userhash"})
+	}
+
+	unlock := lockUser(userHash)
+	defer unlock()
+	retryOnConflict(func() {
+		metadata := Metadata{}
+		storeGetMetadata(userHash, &metadata)
+		authenticate(r, &metadata)
+	})
+	writeBody(w, r, compact(userHash))
+}
+
+// compactEvery compacts the users that pushed changes in the last interval,
+// and drops their abandoned uploads
+func compactEvery(interval time.Duration) {
+	for range time.Tick(interval) {
+		compactPending.Lock()
+		users := compactPending.m
+		compactPending.m = map[string]bool{}
+		compactPending.Unlock()
+		for userHash := range users {
+			func() {
+				defer func() {
+					if err := recover(); err != nil {
+						log.Println("compact: panic:", userHash, err)
+					}
+				}()
+				unlock := lockUser(userHash)
+				defer unlock()
+				compact(userHash)
+				blobsExpireUploads(userHash)
+			}()
+		}
+	}
+}
+
+func compactLater(userHash string) {
+	compactPending.Lock()
+	compactPending.m[userHash] = true
+	compactPending.Unlock()
+}
+
+// compact drops the revisions superseded by a later revision of the same item
+// from all chunks but the last one, which devices are appending to. Only the
+// chunks that lost items are written again, under fresh ids, the others are
+// left alone and chunks left empty are dropped, so nothing is written when
+// nothing was superseded. Items stay in their chunk, so a device syncing from
+// any checkpoint reads the same chunks as before, and as the latest revision of
+// every item is kept, tombstones included, ends up with the same items. The
+// user must be locked.
+func compact(userHash string) CompactResult {
+	result := CompactResult{}
+	retryOnConflict(func() {
+		result = CompactResult{}
+		metadata := Metadata{}
+		storeGetMetadata(userHash, &metadata)
+		active := len(metadata.Chunks) - 1
+		if active < 1 {
+			return
+		}
+
+		chunks := make([][]Item, len(metadata.Chunks))
+		latest := map[int64]int64{}
+		activeVersion := ""
+		for n := range chunks {
+			version := storeGetItems(metadata.chunkKey(n), &chunks[n])
+			if n == active {
+				activeVersion = version
+			}
+			for _, i := range chunks[n] {
+				if rev, ok := latest[i.ID]; !ok || i.Rev > rev {
+					latest[i.ID] = i.Rev
+				}
+			}
+		}
+		seen := map[int64]bool{}
+		for _, i := range chunks[active] {
+			if i.Rev == latest[i.ID] {
+				seen[i.ID] = true
+			}
+		}
+		// walk backwards so the last copy of a revision pushed twice wins
+		kept := make([][]Item, active)
+		for n := active - 1; n >= 0; n-- {
+			result.Before += len(chunks[n])
+			for j := len(chunks[n]) - 1; j >= 0; j-- {
+				i := chunks[n][j]
+				if i.Rev == latest[i.ID] && !seen[i.ID] {
+					seen[i.ID] = true
+					kept[n] = append(kept[n], i)
+				}
+			}
+			result.After += len(kept[n])
+		}
+		if result.After == result.Before {
+			return
+		}
+
+		compacted := metadata
+		compacted.Items, compacted.ItemBytes, compacted.Counted = 0, 0, true
+		compacted.ChunkVersion = activeVersion
+		compacted.Chunks = []int64{}
+		compacted.ChunkIDs = []int64{}
+		compacted.NextChunkID = max64(metadata.NextChunkID, int64(len(metadata.Chunks)))
+		written := []string{}
+		dropped := []string{}
+		committed := false
+		defer func() {
+			if !committed {
+				for _, key := range written {
+					store.Delete(key)
+				}
+			}
+		}()
+		for n := 0; n < active; n++ {
+			if len(kept[n]) == len(chunks[n]) {
+				compacted.Chunks = append(compacted.Chunks, metadata.Chunks[n])
+				compacted.ChunkIDs = append(compacted.ChunkIDs, chunkID(&metadata, n))
+				continue
+			}
+			dropped = append(dropped, metadata.chunkKey(n))
+			if len(kept[n]) == 0 {
+				continue
+			}
+			// kept was filled backwards
+			chunk := make([]Item, len(kept[n]))
+			for j, i := range kept[n] {
+				chunk[len(chunk)-1-j] = i
+			}
+			compacted.Chunks = append(compacted.Chunks, metadata.Chunks[n])
+			compacted.ChunkIDs = append(compacted.ChunkIDs, compacted.NextChunkID)
+			compacted.NextChunkID++
+			key := compacted.chunkKey(len(compacted.ChunkIDs) - 1)
+			storePut(key, &chunk, "")
+			written = append(written, key)
+		}
+		compacted.Chunks = append(compacted.Chunks, metadata.Chunks[active])
+		compacted.ChunkIDs = append(compacted.ChunkIDs, chunkID(&metadata, active))
+		// readers start from the first chunk when the checkpoint is before
+		// the others, chunk 0 may be gone
+		compacted.Chunks[0] = 0
+		for _, chunk := range append(kept[:active:active], chunks[active]) {
+			for _, i := range chunk {
+				compacted.Items++
+				compacted.ItemBytes += i.size()
+			}
+		}
+		storePutMetadata(&compacted)
+		committed = true
+
+		for _, key := range dropped {
+			check(store.Delete(key))
+		}
+	})
+	log.Println("compact", userHash, result.Before, result.After)
+	return result
+}
+
+// scrubCleartext drops the items older clients sent in clear from all the
+// user's chunks once a client upgrading sent all their notes again sealed, so
+// the server keeps nothing it can read. It runs within the caller's
+// retryOnConflict, the user must be locked.
+func scrubCleartext(metadata *Metadata) {
+	dropped := 0
+	for n := range metadata.Chunks {
+		key := metadata.chunkKey(n)
+		chunkItems := []Item{}
+		version := storeGetItems(key, &chunkItems)
+		sealed := []Item{}
+		for _, i := range chunkItems {
+			if len(i.Sealed) > 0 {
+				sealed = append(sealed, i)
+			}
+		}
+		if len(sealed) < len(chunkItems) {
+			storePut(key, &sealed, version)
+			dropped += len(chunkItems) - len(sealed)
+		}
+	}
+	metadata.Scrubbed = true
+	// counted and indexed again, a scrub that conflicted may have dropped
+	// some already
+	metadata.Counted = false
+	metadata.RevsVersion = ""
+	storePutMetadata(metadata)
+	log.Println("scrub", metadata.UserHash, dropped)
+}
+
+func chunkID(m *Metadata, n int) int64 {
+	if n < len(m.ChunkIDs) {
+		return m.ChunkIDs[n]
+	}
+	return int64(n)
+}
+
+func max64(a, b int64) int64 {
+	if a > b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"testing"
+)
+
+// testPages syncs from checkpoint a page of pageSize items at a time until
+// caught up, returning the latest rev received of each item
+func testPages(t *testing.T, checkpoint int64, pageSize int) map[int64]int64 {
+	t.Helper()
+	received := map[int64]int64{}
+	for pages := 0; ; pages++ {
+		if pages > 100 {
+			t.Fatal("never caught up")
+		}
+		r := testRequest(t, "alice", "token", protocolSealed, nil, checkpoint)
+		r.Header.Set("pagesize", strconv.Itoa(pageSize))
+		w := testServe(r)
+		for _, i := range testItems(t, w) {
+			if i.Rev > received[i.ID] {
+				received[i.ID] = i.Rev
+			}
+		}
+		next, err := strconv.ParseInt(w.Header().Get("checkpoint"), 10, 64)
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkpoint = next
+		if w.Header().Get("more") != "true" {
+			return received
+		}
+	}
+}
+
+func TestCompactCheckpoints(t *testing.T) {
+	defer func(size int) { chunkSize = size }(chunkSize)
+	chunkSize = 3
+	testAccount(t, "alice", "token")
+
+	// the second and fourth chunks aren't edited afterwards, the first is
+	// entirely and the third partly
+	ids := []int64{1, 2, 3, 4, 5, 6, 1, 2, 9, 3, 7, 1, 2, 8}
+	latest := map[int64]int64{}
+	for n, id := range ids {
+		rev := int64(n + 1)
+		testSync(t, "alice", "token", protocolSealed, []Item{{ID: id, Rev: rev, Sealed: []byte("sealed")}}, rev)
+		latest[id] = rev
+	}
+	check := func(when string) {
+		t.Helper()
+		for checkpoint := int64(0); checkpoint <= int64(len(ids)); checkpoint++ {
+			received := testPages(t, checkpoint, 2)
+			for id, rev := range latest {
+				if rev > checkpoint && received[id] != rev {
+					t.Errorf("%s, from %d: item %d at %d, expected %d", when, checkpoint, id, received[id], rev)
+				}
+			}
+		}
+	}
+	check("before compacting")
+
+	result := compact("alice")
+	if result.After >= result.Before {
+		t.Fatalf("nothing compacted: %+v", result)
+	}
+	check("after compacting")
+
+	after := Metadata{}
+	storeGetMetadata("alice", &after)
+	if fmt.Sprint(after.ChunkIDs) != "[1 5 3 4]" {
+		t.Errorf("expected the first chunk dropped and the third written again, got %v", after.ChunkIDs)
+	}
+	if again := compact("alice"); again.After != again.Before {
+		t.Errorf("compacting again dropped items: %+v", again)
+	}
+	unchanged := Metadata{}
+	storeGetMetadata("alice", &unchanged)
+	if unchanged.version != after.version {
+		t.Errorf("compacting again wrote the metadata")
+	}
+}
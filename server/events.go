@@ -0,0 +1,96 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// subscribers holds, per user, the event streams of connected devices keyed
+// by device id. Only devices connected to this process are notified, with
+// several processes the others still catch up when they poll.
+var subscribers = struct {
+	sync.Mutex
+	m map[string]map[chan struct{}]string
+}{m: map[string]map[chan struct{}]string{}}
+
+var eventsKeepAlive = 30 * time.Second
+
+// handleEvents streams server-sent events to a logged in device, a "changes"
+// event is sent whenever another of the user's devices pushes changes
+func handleEvents(w http.ResponseWriter, r *http.Request) {
+	defer handleErrors(w, r)
+	userHash := r.Header.Get("userhash")
+	if !userHashRe.MatchString(userHash) {
+		panic(httpError{400, "invalid_userhash", "invalid userhash"})
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		panic(httpError{500, "internal", "streaming unsupported"})
+	}
+
+	deviceID := ""
+	func() {
+		unlock := lockUser(userHash)
+		defer unlock()
+		retryOnConflict(func() {
+			metadata := Metadata{}
+			storeGetMetadata(userHash, &metadata)
+			deviceID = authenticate(r, &metadata).ID
+		})
+	}()
+
+	c := make(chan struct{}, 1)
+	subscribers.Lock()
+	if subscribers.m[userHash] == nil {
+		subscribers.m[userHash] = map[chan struct{}]string{}
+	}
+	subscribers.m[userHash][c] = deviceID
+	subscribers.Unlock()
+	defer func() {
+		subscribers.Lock()
+		delete(subscribers.m[userHash], c)
+		if len(subscribers.m[userHash]) == 0 {
+			delete(subscribers.m, userHash)
+		}
+		subscribers.Unlock()
+	}()
+	log.Println("events", userHash, deviceID)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(200)
+	fmt.Fprint(w, ": connected\n\n")
+	flusher.Flush()
+	keepAlive := time.NewTicker(eventsKeepAlive)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-c:
+			fmt.Fprint(w, "event: changes\ndata: \n\n")
+		case <-keepAlive.C:
+			fmt.Fprint(w, ": keep-alive\n\n")
+		}
+		flusher.Flush()
+	}
+}
+
+// notifySubscribers tells the user's connected devices, but the one that
+// pushed the changes, to sync
+func notifySubscribers(userHash, deviceID string) {
+	subscribers.Lock()
+	defer subscribers.Unlock()
+	for c, id := range subscribers.m[userHash] {
+		if id == deviceID && deviceID != "" {
+			continue
+		}
+		select {
+		case c <- struct{}{}:
+		default:
+		}
+	}
+}
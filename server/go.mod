@@ -4,6 +4,7 @@ go 1.17
 
 require (
 	github.com/aws/aws-sdk-go v1.42.50
+	github.com/mattn/go-sqlite3 v1.14.11
 	golang.org/x/crypto v0.0.0-20220210151621-f4118a5b28e2
 )
 
@@ -4,94 +4,301 @@ import (
 	"bytes"
 	"encoding/gob"
 	"encoding/hex"
+	"encoding/json"
+	"flag"
 	"fmt"
-	"io/ioutil"
 	"log"
 	"net/http"
 	"os"
 	"regexp"
 	"sort"
 	"strconv"
+	"strings"
+	"sync"
+	"time"
 
-	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/awserr"
-	"github.com/aws/aws-sdk-go/aws/credentials"
-	"github.com/aws/aws-sdk-go/aws/session"
-	"github.com/aws/aws-sdk-go/service/s3"
 	"golang.org/x/crypto/bcrypt"
 )
 
+// Item is a revision of a note, Data holds it in the clear for clients
+// speaking protocol versions before 3, Sealed is what they send since, the
+// note encrypted with a key only they have
 type Item struct {
-	ID   int64
-	Rev  int64
-	Data string
+	ID     int64
+	Rev    int64
+	Data   string
+	Sealed []byte
 }
 
 type Metadata struct {
 	UserHash string
-	PassHash []byte
-	Chunks   []int64
+	PassHash []byte // bcrypt of the passkey, only for accounts not yet enrolled
+	Salt     []byte
+	Verifier []byte
+	Devices  []Device
+	Chunks   []int64 // chunk n holds the revs after Chunks[n]
+	// chunk n is stored under ChunkIDs[n], or n when there are fewer ids
+	// than chunks, compaction moves chunks to fresh ids from NextChunkID
+	ChunkIDs    []int64
+	NextChunkID int64
+	// MinProtocol is the oldest protocol version allowed to sync, raised once
+	// sealed items were pushed as older clients can't read them
+	MinProtocol int
+	// Scrubbed is set once the items older clients sent in clear were dropped
+	// from all chunks, after MinProtocol was raised
+	Scrubbed bool
+	// Blobs are the user's attachments by id, BlobBytes their total size,
+	// Uploads the ones being uploaded in parts
+	Blobs     map[string]Blob
+	BlobBytes int64
+	Uploads   map[string]*Upload
+	// Items and ItemBytes count the items in the user's chunks once Counted,
+	// as of the active chunk's ChunkVersion, when the chunk is at another
+	// version a write stored items and lost the race to update the metadata,
+	// and they are counted again
+	Items        int64
+	ItemBytes    int64
+	Counted      bool
+	ChunkVersion string
+	// RevsVersion is the version of the user's Revs the chunks agree with,
+	// they are built again when it's at another
+	RevsVersion string
+
+	version string
+}
+
+// Revs holds the latest rev stored of each of a user's items, and whether it
+// was sealed, under "<userhash>/_revs", so changes pushed again after a
+// failure aren't stored twice wherever they are
+type Revs map[int64]StoredRev
+
+type StoredRev struct {
+	Rev    int64
+	Sealed bool
 }
 
-var s3Client *s3.S3
-var bucket = os.Getenv("S3_BUCKET")
+// covers tells whether storing i would be useless, clients only keep the
+// latest rev of an item, but for a sealed copy of a rev stored in clear
+func (revs Revs) covers(i Item) bool {
+	stored, ok := revs[i.ID]
+	return ok && (stored.Rev > i.Rev || stored.Rev == i.Rev && (stored.Sealed || len(i.Sealed) == 0))
+}
+
+func (revs Revs) add(i Item) {
+	if !revs.covers(i) {
+		revs[i.ID] = StoredRev{i.Rev, len(i.Sealed) > 0}
+	}
+}
+
+// httpError is panicked by handlers to answer with Status, its Code is one
+// of a few stable strings clients can tell errors apart with
+type httpError struct {
+	Status  int
+	Code    string
+	Message string
+}
+
+var store Store
+var maxPageSize = 1000
+var chunkSize = 500
+
+// limits on what a single request can send
+var (
+	maxBodySize int64 = 16 << 20
+	maxItems          = 1000
+	maxItemSize       = 1 << 20
+	// readTimeout bounds how long a request can take to send, parts of
+	// blobs included
+	readTimeout = time.Minute
+)
 var userHashRe = regexp.MustCompile("^[a-zA-Z0-9]+$")
 
 func main() {
 	gob.Register(Item{})
 	gob.Register(Metadata{})
 
-	config := &aws.Config{}
-	config.Region = aws.String("us-east-1")
-	config.Credentials = credentials.NewStaticCredentials(
-		os.Getenv("AWS_ACCESS_KEY"), os.Getenv("AWS_SECRET_KEY"), "")
-	s3Session := session.Must(session.NewSession(config))
-	s3Client = s3.New(s3Session)
+	storeKind := flag.String("store", envOr("STORE", "s3"), "storage backend: s3, fs, sqlite or memory")
+	storePath := flag.String("store-path", envOr("STORE_PATH", os.Getenv("S3_BUCKET")),
+		"bucket for s3, directory for fs, database file for sqlite")
+	pageSize, err := strconv.Atoi(envOr("PAGE_SIZE", strconv.Itoa(maxPageSize)))
+	check(err)
+	flag.IntVar(&maxPageSize, "page-size", pageSize, "most items sent back by a single sync request")
+	readTimeout, err = time.ParseDuration(envOr("READ_TIMEOUT", readTimeout.String()))
+	check(err)
+	flag.DurationVar(&readTimeout, "read-timeout", readTimeout, "longest a client can take to send a request")
+	compactInterval, err := time.ParseDuration(envOr("COMPACT_EVERY", "0"))
+	check(err)
+	flag.DurationVar(&compactInterval, "compact-every", compactInterval,
+		"how often to compact the chunks of users that synced changes, 0 to never")
+	blobGrace, err = time.ParseDuration(envOr("BLOB_GRACE", blobGrace.String()))
+	check(err)
+	flag.DurationVar(&blobGrace, "blob-grace", blobGrace,
+		"how long attachments no note refers to are kept, for notes still on their way to other devices")
+	quotaItems, err = strconv.ParseInt(envOr("QUOTA_ITEMS", "0"), 10, 64)
+	check(err)
+	flag.Int64Var(&quotaItems, "quota-items", quotaItems, "most items a user can store, 0 for no limit")
+	check(sizeFlag{&quotaBytes}.Set(envOr("QUOTA_BYTES", "0")))
+	flag.Var(sizeFlag{&quotaBytes}, "quota-bytes", "most bytes of notes a user can store, such as 100MB, 0 for no limit")
+	check(sizeFlag{&quotaBlobBytes}.Set(envOr("QUOTA_BLOB_BYTES", "0")))
+	flag.Var(sizeFlag{&quotaBlobBytes}, "quota-blob-bytes", "most bytes of attachments a user can store, such as 1GB, 0 for no limit")
+	flag.StringVar(&registration, "registration", envOr("REGISTRATION", registration),
+		"who can create an account: open, invite or closed")
+	inviteList := flag.String("invites", os.Getenv("INVITES"), "comma separated invites, each creating one account, with -registration invite")
+	flag.Parse()
+	if registration != "open" && registration != "invite" && registration != "closed" {
+		log.Fatalln("invalid registration", registration)
+	}
+	for _, invite := range strings.Split(*inviteList, ",") {
+		if invite = strings.TrimSpace(invite); invite != "" {
+			invites[invite] = true
+		}
+	}
+	store, err = newStore(*storeKind, *storePath)
+	check(err)
 
 	port := os.Getenv("PORT")
 	if port == "" {
 		port = "8000"
 	}
-	log.Println("start on port", port)
-	http.ListenAndServe(":"+port, http.HandlerFunc(handle))
+	http.HandleFunc("/", withProtocol(handle))
+	http.HandleFunc("/login", withProtocol(handleLogin))
+	http.HandleFunc("/signup", withProtocol(handleSignup))
+	http.HandleFunc("/enroll", withProtocol(handleEnroll))
+	http.HandleFunc("/devices", withProtocol(handleDevices))
+	http.HandleFunc("/compact", withProtocol(handleCompact))
+	http.HandleFunc("/events", withProtocol(handleEvents))
+	http.HandleFunc("/usage", withProtocol(handleUsage))
+	http.HandleFunc("/blobs", withProtocol(handleBlobs))
+	http.HandleFunc("/blobs/", withProtocol(handleBlobs))
+	if compactInterval > 0 {
+		go compactEvery(compactInterval)
+	}
+	log.Println("start on port", port, "with store", *storeKind)
+	// no write timeout, /events answers for as long as devices listen
+	server := &http.Server{
+		Addr:              ":" + port,
+		ReadHeaderTimeout: 10 * time.Second,
+		ReadTimeout:       readTimeout,
+		IdleTimeout:       2 * time.Minute,
+	}
+	log.Fatal(server.ListenAndServe())
 }
 
-func handle(w http.ResponseWriter, r *http.Request) {
-	defer func() {
-		if err := recover(); err != nil {
-			log.Println("panic:", r.Header.Get("userhash"), err)
-			w.WriteHeader(500)
+// handleErrors answers with the httpError a handler panicked with, as json,
+// anything else is a 500, or a 503 when the store stayed too busy to write
+func handleErrors(w http.ResponseWriter, r *http.Request) {
+	if err := recover(); err != nil {
+		log.Println("panic:", r.URL.Path, r.Header.Get("userhash"), err)
+		herr, ok := err.(httpError)
+		if !ok && err == errConflict {
+			herr = httpError{503, "busy", "too many concurrent changes, try again"}
+		} else if !ok {
+			herr = httpError{500, "internal", "internal error"}
 		}
-	}()
+		writeError(w, herr)
+	}
+}
+
+func writeError(w http.ResponseWriter, herr httpError) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(herr.Status)
+	json.NewEncoder(w).Encode(map[string]string{"error": herr.Code, "message": herr.Message})
+}
+
+func handle(w http.ResponseWriter, r *http.Request) {
+	defer handleErrors(w, r)
 
 	defer r.Body.Close()
-	changes := []Item{}
-	check(gob.NewDecoder(r.Body).Decode(&changes))
-	userHash := r.Header.Get("userhash")
-	passKey, err := hex.DecodeString(r.Header.Get("passkey"))
-	if err != nil {
-		panic("invalid passkey")
+	changes := readItems(r)
+	if len(changes) > maxItems {
+		panic(httpError{413, "too_many_items", fmt.Sprintf("at most %d changes can be sent at once", maxItems)})
 	}
+	for _, i := range changes {
+		if i.ID <= 0 || i.Rev <= 0 {
+			panic(httpError{400, "invalid_item", "invalid item id or rev"})
+		}
+		if len(i.Data) > maxItemSize || len(i.Sealed) > maxItemSize {
+			panic(httpError{413, "item_too_large", fmt.Sprintf("items can't be larger than %d bytes", maxItemSize)})
+		}
+	}
+	userHash := r.Header.Get("userhash")
 	checkpoint, err := strconv.ParseInt(r.Header.Get("checkpoint"), 10, 64)
 	if err != nil {
-		panic("invalid checkpoint")
+		panic(httpError{400, "invalid_checkpoint", "invalid checkpoint"})
 	}
 
 	if !userHashRe.MatchString(userHash) {
-		panic("invalid userhash")
+		panic(httpError{400, "invalid_userhash", "invalid userhash"})
+	}
+	pageSize := maxPageSize
+	if r.Header.Get("pagesize") != "" {
+		pageSize, err = strconv.Atoi(r.Header.Get("pagesize"))
+		if err != nil || pageSize < 1 {
+			panic(httpError{400, "invalid_pagesize", "invalid pagesize"})
+		}
+		pageSize = min(pageSize, maxPageSize)
 	}
 
+	unlock := lockUser(userHash)
+	defer unlock()
+	items := []Item{}
+	more := false
+	deviceID := ""
+	retryOnConflict(func() {
+		items, more, deviceID = syncItems(r, userHash, changes, checkpoint, pageSize, true)
+	})
+	if len(changes) > 0 {
+		compactLater(userHash)
+		notifySubscribers(userHash, deviceID)
+	}
+	if len(items) > 0 {
+		checkpoint = items[len(items)-1].Rev
+	}
+	log.Println("request", userHash, len(changes), len(items), checkpoint, more)
+	w.Header().Set("checkpoint", strconv.FormatInt(checkpoint, 10))
+	w.Header().Set("more", strconv.FormatBool(more))
+	writeItems(w, r, items)
+}
+
+// syncItems stores the user's changes and returns up to pageSize items after
+// checkpoint, ordered by rev, whether there are more to come and the id of the
+// device syncing, empty for legacy clients. Changes taking the user over their
+// quota are refused, after compacting their chunks when compactFirst.
+func syncItems(r *http.Request, userHash string, changes []Item, checkpoint int64, pageSize int, compactFirst bool) ([]Item, bool, string) {
 	metadata := Metadata{}
-	s3GetMetadata(userHash+"/_meta", &metadata)
-	if metadata.UserHash == "" {
-		metadata.UserHash = userHash
-		metadata.PassHash, err = bcrypt.GenerateFromPassword(passKey, 11)
-		check(err)
-		metadata.Chunks = []int64{0}
-		s3Put(userHash+"/_meta", &metadata)
+	storeGetMetadata(userHash, &metadata)
+	deviceID := ""
+	if r.Header.Get("session") != "" {
+		deviceID = authenticate(r, &metadata).ID
 	} else {
-		if err := bcrypt.CompareHashAndPassword(metadata.PassHash, passKey); err != nil {
-			panic("wrong password")
+		// legacy clients send their passkey on every request
+		passKey, err := hex.DecodeString(r.Header.Get("passkey"))
+		if err != nil {
+			panic(httpError{400, "invalid_passkey", "invalid passkey"})
+		}
+		if metadata.UserHash == "" {
+			panic(httpError{404, "account_not_found", "account not found"})
+		} else if len(metadata.PassHash) == 0 {
+			panic(httpError{401, "login_required", "login required"})
+		} else if err := bcrypt.CompareHashAndPassword(metadata.PassHash, passKey); err != nil {
+			panic(httpError{401, "wrong_password", "wrong password"})
+		}
+	}
+	protocol := protocolOf(r)
+	// set on the last request of a device sending all its notes again sealed
+	resealed := protocol >= protocolSealed && r.Header.Get("resealed") == "true"
+	if protocol < metadata.MinProtocol {
+		panic(httpError{426, "sealed_account", fmt.Sprintf("this account's notes are sealed, update to a client speaking protocol %d", metadata.MinProtocol)})
+	}
+	if protocol >= protocolSealed {
+		for _, i := range changes {
+			if i.Data != "" || len(i.Sealed) == 0 {
+				panic(httpError{400, "unsealed_changes", "changes must be sealed"})
+			}
+		}
+		if (len(changes) > 0 || resealed) && metadata.MinProtocol < protocolSealed {
+			metadata.MinProtocol = protocolSealed
+			storePutMetadata(&metadata)
 		}
 	}
 
@@ -99,78 +306,246 @@ func handle(w http.ResponseWriter, r *http.Request) {
 		return changes[i].Rev < changes[j].Rev
 	})
 	if len(changes) > 0 {
-		chunkKey := fmt.Sprintf("%s/%d", userHash, len(metadata.Chunks)-1)
+		chunkKey := metadata.chunkKey(len(metadata.Chunks) - 1)
 		chunkItems := []Item{}
-		s3GetItems(chunkKey, &chunkItems)
-		chunkItems = append(chunkItems, changes...)
-		s3Put(chunkKey, &chunkItems)
-		if len(chunkItems) >= 500 {
-			metadata.Chunks = append(metadata.Chunks, chunkItems[len(chunkItems)-1].Rev)
-			s3Put(userHash+"/_meta", &metadata)
+		chunkVersion := storeGetItems(chunkKey, &chunkItems)
+		if len(chunkItems) >= chunkSize {
+			// a write filled the chunk and lost the race to start the next
+			// one, full chunks are never written to again
+			countItems(&metadata)
+			metadata.addChunk(chunkItems)
+			metadata.ChunkVersion = ""
+			storePutMetadata(&metadata)
+			return syncItems(r, userHash, changes, checkpoint, pageSize, compactFirst)
+		}
+		recounted, indexed := false, false
+		if !metadata.Counted || chunkVersion != metadata.ChunkVersion {
+			countItems(&metadata)
+			metadata.ChunkVersion = chunkVersion
+			recounted = true
+		}
+		revs := Revs{}
+		revsVersion := storeGetRevs(userHash, &revs)
+		if recounted || revsVersion != metadata.RevsVersion {
+			// a write that lost the race may not have indexed its items
+			revs = indexRevs(&metadata)
+			indexed = true
+		}
+		// skip changes already stored, by an attempt that conflicted later on
+		// or a device pushing them again after a failure, but let sealed
+		// copies replace revisions that were sent in the clear
+		stored := map[[2]int64]int{}
+		for n, i := range chunkItems {
+			stored[[2]int64{i.ID, i.Rev}] = n
+		}
+		added, addedItems, addedBytes := []Item{}, int64(0), int64(0)
+		for _, i := range changes {
+			if revs.covers(i) {
+				continue
+			}
+			revs.add(i)
+			n, ok := stored[[2]int64{i.ID, i.Rev}]
+			if !ok {
+				chunkItems = append(chunkItems, i)
+				added = append(added, i)
+				addedItems++
+				addedBytes += i.size()
+			} else {
+				addedBytes += i.size() - chunkItems[n].size()
+				chunkItems[n] = i
+				added = append(added, i)
+			}
+		}
+		if limit := quotaExceeded(&metadata, addedItems, addedBytes); limit != "" {
+			if compactFirst && len(metadata.Chunks) > 1 {
+				// superseded revisions may be all that's over the quota
+				compact(userHash)
+				return syncItems(r, userHash, changes, checkpoint, pageSize, false)
+			}
+			if limit := quotaExceededLatest(&metadata, added); limit != "" {
+				panic(quotaError(limit))
+			}
 		}
+		if len(added) > 0 {
+			metadata.ChunkVersion = storePut(chunkKey, &chunkItems, chunkVersion)
+			metadata.Items += addedItems
+			metadata.ItemBytes += addedBytes
+		}
+		if len(added) > 0 || indexed {
+			metadata.RevsVersion = storePut(userHash+"/_revs", &revs, revsVersion)
+		}
+		if len(chunkItems) >= chunkSize {
+			metadata.addChunk(chunkItems)
+			metadata.ChunkVersion = ""
+		}
+		if len(added) > 0 || len(chunkItems) >= chunkSize || recounted || indexed {
+			storePutMetadata(&metadata)
+		}
+	}
+	// until the device sent all its notes sealed the items in clear are the
+	// only copy of the ones it didn't get to, it may never get to them
+	if resealed && !metadata.Scrubbed {
+		scrubCleartext(&metadata)
 	}
 
+	// a device that was offline can push older revs late, so all the chunks
+	// after the one holding checkpoint are read
 	chunkIndex := 0
 	for i, rev := range metadata.Chunks {
-		if checkpoint < rev {
+		if rev <= checkpoint {
 			chunkIndex = i
 		}
 	}
-	chunkItems := []Item{}
-	s3GetItems(fmt.Sprintf("%s/%d", userHash, chunkIndex), &chunkItems)
+	// a revision pushed again after its chunk was full, by a device that
+	// missed the answer or a write that conflicted, is sent once
 	items := []Item{}
-	for _, i := range chunkItems {
-		if i.Rev > checkpoint {
-			items = append(items, i)
+	sent := map[[2]int64]int{}
+	for ; chunkIndex < len(metadata.Chunks); chunkIndex++ {
+		chunkItems := []Item{}
+		storeGetItems(metadata.chunkKey(chunkIndex), &chunkItems)
+		for _, i := range chunkItems {
+			if n, ok := sent[[2]int64{i.ID, i.Rev}]; ok {
+				items[n] = i
+			} else if i.Rev > checkpoint {
+				sent[[2]int64{i.ID, i.Rev}] = len(items)
+				items = append(items, i)
+			}
 		}
 	}
-	if len(items) > 0 {
-		checkpoint = items[len(items)-1].Rev
+	sort.SliceStable(items, func(i, j int) bool {
+		return items[i].Rev < items[j].Rev
+	})
+	if len(items) <= pageSize {
+		return items, false, deviceID
 	}
-	log.Println("request", userHash, len(changes), len(items), checkpoint)
-	w.Header().Set("checkpoint", strconv.FormatInt(checkpoint, 10))
-	check(gob.NewEncoder(w).Encode(items))
+	// pages end between revs, the next one starting after the last rev sent
+	end := pageSize
+	for end > 0 && items[end-1].Rev == items[end].Rev {
+		end--
+	}
+	for end == 0 || end < len(items) && items[end-1].Rev == items[end].Rev {
+		end++
+	}
+	return items[:end], end < len(items), deviceID
+}
+
+func (m *Metadata) chunkKey(n int) string {
+	id := int64(n)
+	if n < len(m.ChunkIDs) {
+		id = m.ChunkIDs[n]
+	}
+	return fmt.Sprintf("%s/%d", m.UserHash, id)
+}
+
+// addChunk starts a new chunk for the revs after the highest of full, the
+// last item of a chunk isn't always it as devices can push older revs late,
+// starting the new chunk lower would make readers skip the ones above it
+func (m *Metadata) addChunk(full []Item) {
+	rev := int64(0)
+	for _, i := range full {
+		rev = max64(rev, i.Rev)
+	}
+	if len(m.ChunkIDs) > 0 {
+		m.ChunkIDs = append(m.ChunkIDs, m.NextChunkID)
+		m.NextChunkID++
+	}
+	m.Chunks = append(m.Chunks, rev)
 }
 
-func s3GetMetadata(key string, v *Metadata) {
-	bs := s3Get(key)
+var userLocks = struct {
+	sync.Mutex
+	m map[string]*sync.Mutex
+}{m: map[string]*sync.Mutex{}}
+
+// lockUser serializes requests changing a user's objects within this process,
+// the store's versions catch writes from other processes
+func lockUser(userHash string) func() {
+	userLocks.Lock()
+	l := userLocks.m[userHash]
+	if l == nil {
+		l = &sync.Mutex{}
+		userLocks.m[userHash] = l
+	}
+	userLocks.Unlock()
+	l.Lock()
+	return l.Unlock
+}
+
+// retryOnConflict runs fn again when an object it read was changed by someone
+// else before it wrote it back, fn must redo all its reads
+func retryOnConflict(fn func()) {
+	for attempt := 1; ; attempt++ {
+		conflicted := func() (conflicted bool) {
+			defer func() {
+				if err := recover(); err != nil {
+					if err != errConflict || attempt == 5 {
+						panic(err)
+					}
+					conflicted = true
+				}
+			}()
+			fn()
+			return false
+		}()
+		if !conflicted {
+			return
+		}
+		log.Println("conflict, retrying", attempt)
+	}
+}
+
+func storeGetMetadata(userHash string, v *Metadata) {
+	bs, version, err := store.Get(userHash + "/_meta")
+	check(err)
 	if len(bs) > 0 {
 		check(gob.NewDecoder(bytes.NewReader(bs)).Decode(v))
 	}
+	v.version = version
+}
+
+func storePutMetadata(v *Metadata) {
+	v.version = storePut(v.UserHash+"/_meta", v, v.version)
 }
 
-func s3GetItems(key string, v *[]Item) {
-	bs := s3Get(key)
+func storeGetRevs(userHash string, v *Revs) string {
+	bs, version, err := store.Get(userHash + "/_revs")
+	check(err)
 	if len(bs) > 0 {
 		check(gob.NewDecoder(bytes.NewReader(bs)).Decode(v))
 	}
+	return version
 }
 
-func s3Get(key string) []byte {
-	result, err := s3Client.GetObject(&s3.GetObjectInput{
-		Bucket: aws.String(bucket),
-		Key:    aws.String(key),
-	})
-	if aerr, ok := err.(awserr.Error); ok && aerr.Code() == s3.ErrCodeNoSuchKey {
-		return []byte{}
-	}
-	check(err)
-	defer result.Body.Close()
-	bs, err := ioutil.ReadAll(result.Body)
+func storeGetItems(key string, v *[]Item) string {
+	bs, version, err := store.Get(key)
 	check(err)
-	return bs
+	if len(bs) > 0 {
+		check(gob.NewDecoder(bytes.NewReader(bs)).Decode(v))
+	}
+	return version
 }
 
-func s3Put(key string, v interface{}) {
+// storePut writes v if the object is still at version, see Store
+func storePut(key string, v interface{}, version string) string {
 	b := bytes.NewBuffer([]byte{})
 	check(gob.NewEncoder(b).Encode(v))
-	_, err := s3Client.PutObject(&s3.PutObjectInput{
-		ACL:    aws.String("private"),
-		Bucket: aws.String(bucket),
-		Key:    aws.String(key),
-		Body:   bytes.NewReader(b.Bytes()),
-	})
+	version, err := store.Put(key, b.Bytes(), version)
 	check(err)
+	return version
+}
+
+func min(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func envOr(name, fallback string) string {
+	if v := os.Getenv(name); v != "" {
+		return v
+	}
+	return fallback
 }
 
 func check(err error) {
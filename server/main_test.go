@@ -0,0 +1,298 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/gob"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testAccount starts a fresh memory store holding an account with a device
+// logged in with token
+func testAccount(t *testing.T, userHash, token string) {
+	t.Helper()
+	store = newMemoryStore()
+	tokenHash := sha256.Sum256([]byte(token))
+	now := time.Now()
+	metadata := Metadata{UserHash: userHash, Chunks: []int64{0}, Counted: true, Devices: []Device{{
+		ID: "device", TokenHash: tokenHash[:], Created: now.Unix(), LastSeen: now.Unix(), Expires: now.Add(time.Hour).Unix(),
+	}}}
+	storePutMetadata(&metadata)
+}
+
+// testRequest builds the sync request of a device speaking protocol pushing
+// changes and asking for the items after checkpoint
+func testRequest(t *testing.T, userHash, token string, protocol int, changes []Item, checkpoint int64) *http.Request {
+	t.Helper()
+	var body bytes.Buffer
+	if err := gob.NewEncoder(&body).Encode(changes); err != nil {
+		t.Fatal(err)
+	}
+	r := httptest.NewRequest("POST", "/", &body)
+	r.Header.Set("protocol", strconv.Itoa(protocol))
+	r.Header.Set("userhash", userHash)
+	r.Header.Set("session", token)
+	r.Header.Set("checkpoint", strconv.FormatInt(checkpoint, 10))
+	return r
+}
+
+// testServe answers r like the server does
+func testServe(r *http.Request) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	withProtocol(handle)(w, r)
+	return w
+}
+
+// testSync pushes changes as a device speaking protocol, and returns the items
+// after checkpoint the server answered with
+func testSync(t *testing.T, userHash, token string, protocol int, changes []Item, checkpoint int64) []Item {
+	t.Helper()
+	return testItems(t, testServe(testRequest(t, userHash, token, protocol, changes, checkpoint)))
+}
+
+// testItems decodes the items of a successful sync
+func testItems(t *testing.T, w *httptest.ResponseRecorder) []Item {
+	t.Helper()
+	if w.Code != 200 {
+		t.Fatalf("sync: %d %s", w.Code, w.Body.String())
+	}
+	items := []Item{}
+	if err := gob.NewDecoder(w.Body).Decode(&items); err != nil {
+		t.Fatal(err)
+	}
+	return items
+}
+
+// testSeal seals data like clients do, the server only needs it opaque
+func testSeal(t *testing.T, key, data []byte) []byte {
+	t.Helper()
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	rand.Read(nonce)
+	return gcm.Seal(nonce, nonce, data, nil)
+}
+
+func TestStoredItemsSealed(t *testing.T) {
+	defer func(size int) { chunkSize = size }(chunkSize)
+	chunkSize = 3
+	testAccount(t, "alice", "token")
+	marker := "plaintext marker"
+
+	// notes synced in clear by an older client, edited a few times so
+	// superseded revisions end up in older chunks
+	latest := map[int64]Item{}
+	rev := int64(1)
+	for edit := 0; edit < 3; edit++ {
+		changes := []Item{}
+		for id := int64(1); id <= 4; id++ {
+			i := Item{ID: id, Rev: rev, Data: marker + " " + strconv.Itoa(edit)}
+			changes = append(changes, i)
+			latest[id] = i
+			rev++
+		}
+		testSync(t, "alice", "token", 2, changes, 0)
+	}
+
+	// the upgraded client sends them all again sealed, in two requests
+	key := make([]byte, 32)
+	rand.Read(key)
+	changes := []Item{}
+	for id := int64(1); id <= 4; id++ {
+		i := latest[id]
+		changes = append(changes, Item{ID: i.ID, Rev: i.Rev, Sealed: testSeal(t, key, []byte(i.Data))})
+	}
+	testSync(t, "alice", "token", 3, changes[:2], 0)
+	// a device gone before sending the rest mustn't lose them for the others
+	s := store.(*memoryStore)
+	for _, i := range latest {
+		if i.ID <= 2 {
+			continue
+		}
+		found := false
+		for _, data := range s.objects {
+			found = found || bytes.Contains(data, []byte(i.Data))
+		}
+		if !found {
+			t.Errorf("note %d dropped before the client sent it sealed", i.ID)
+		}
+	}
+	r := testRequest(t, "alice", "token", 3, changes[2:], 0)
+	r.Header.Set("resealed", "true")
+	items := testItems(t, testServe(r))
+	if len(items) != len(latest) {
+		t.Errorf("synced %d items, expected %d", len(items), len(latest))
+	}
+	for _, i := range items {
+		if i.Data != "" || len(i.Sealed) == 0 {
+			t.Errorf("item %d %d sent back unsealed", i.ID, i.Rev)
+		}
+	}
+
+	for key, data := range s.objects {
+		if bytes.Contains(data, []byte(marker)) {
+			t.Errorf("%s holds plaintext", key)
+		}
+	}
+	metadata := Metadata{}
+	storeGetMetadata("alice", &metadata)
+	if len(metadata.Chunks) < 2 {
+		t.Errorf("expected items spread over several chunks, got %d", len(metadata.Chunks))
+	}
+}
+
+// TestConcurrentSyncs has devices push to the same account at once, half of
+// them through handle, serialized by lockUser, and half straight to syncItems
+// as another server process would, relying on the store's versions, and
+// checks no change was lost
+func TestConcurrentSyncs(t *testing.T) {
+	defer func(size int) { chunkSize = size }(chunkSize)
+	chunkSize = 5
+	testAccount(t, "alice", "token")
+	const devices, pushes = 8, 20
+
+	var wg sync.WaitGroup
+	for d := 0; d < devices; d++ {
+		wg.Add(1)
+		go func(d int) {
+			defer wg.Done()
+			for p := 0; p < pushes; p++ {
+				id := int64(d*pushes + p + 1)
+				changes := []Item{{ID: id, Rev: id, Sealed: []byte("sealed " + strconv.FormatInt(id, 10))}}
+				// pushed again when the server is too busy, like clients do
+				for attempt := 0; !testPushConcurrently(t, changes, d%2 == 0); attempt++ {
+					if attempt == 100 {
+						t.Errorf("device %d: always busy", d)
+						return
+					}
+				}
+			}
+		}(d)
+	}
+	wg.Wait()
+
+	items := testSync(t, "alice", "token", 3, nil, 0)
+	found := map[int64]bool{}
+	for _, i := range items {
+		found[i.ID] = true
+	}
+	for id := int64(1); id <= devices*pushes; id++ {
+		if !found[id] {
+			t.Errorf("item %d was lost", id)
+		}
+	}
+	if len(items) != devices*pushes {
+		t.Errorf("synced %d items, expected %d", len(items), devices*pushes)
+	}
+	// a revision can be stored twice until compaction, but has to be counted
+	metadata := Metadata{}
+	storeGetMetadata("alice", &metadata)
+	stored := int64(0)
+	for n := range metadata.Chunks {
+		chunkItems := []Item{}
+		storeGetItems(metadata.chunkKey(n), &chunkItems)
+		stored += int64(len(chunkItems))
+	}
+	if metadata.Items != stored {
+		t.Errorf("counted %d items, stored %d", metadata.Items, stored)
+	}
+}
+
+func TestLateRevisionChunkStart(t *testing.T) {
+	defer func(size int) { chunkSize = size }(chunkSize)
+	chunkSize = 3
+	testAccount(t, "alice", "token")
+	sealed := []byte("sealed")
+	testSync(t, "alice", "token", 3, []Item{{ID: 1, Rev: 10, Sealed: sealed}, {ID: 2, Rev: 20, Sealed: sealed}}, 0)
+	// an offline device pushing an older rev late fills the chunk
+	testSync(t, "alice", "token", 3, []Item{{ID: 3, Rev: 5, Sealed: sealed}}, 20)
+	testSync(t, "alice", "token", 3, []Item{{ID: 4, Rev: 30, Sealed: sealed}}, 20)
+
+	items := testSync(t, "alice", "token", 3, nil, 10)
+	revs := []int64{}
+	for _, i := range items {
+		revs = append(revs, i.Rev)
+	}
+	if len(revs) != 2 || revs[0] != 20 || revs[1] != 30 {
+		t.Errorf("synced revs %v after checkpoint 10, expected [20 30]", revs)
+	}
+}
+
+func TestPushedAgain(t *testing.T) {
+	defer func(size int) { chunkSize = size }(chunkSize)
+	chunkSize = 2
+	testAccount(t, "alice", "token")
+	batch := []Item{}
+	for id := int64(1); id <= 3; id++ {
+		batch = append(batch, Item{ID: id, Rev: id, Sealed: []byte("sealed")})
+	}
+	testSync(t, "alice", "token", 3, batch, 0)
+	testSync(t, "alice", "token", 3, []Item{{ID: 4, Rev: 4, Sealed: []byte("sealed")}}, 3)
+	// the answer was lost, the batch comes again once its chunk is full
+	items := testSync(t, "alice", "token", 3, batch, 0)
+	if len(items) != 4 {
+		t.Errorf("synced %d items, expected 4", len(items))
+	}
+	metadata := Metadata{}
+	storeGetMetadata("alice", &metadata)
+	if metadata.Items != 4 {
+		t.Errorf("counted %d items, expected 4", metadata.Items)
+	}
+}
+
+func TestPagesEndBetweenRevs(t *testing.T) {
+	testAccount(t, "alice", "token")
+	changes := []Item{}
+	for id := int64(1); id <= 5; id++ {
+		changes = append(changes, Item{ID: id, Rev: 10 + id/4, Sealed: []byte("sealed")})
+	}
+	testSync(t, "alice", "token", 3, changes, 0)
+	// ids 1 to 3 share rev 10, ids 4 and 5 rev 11
+	for pageSize := 1; pageSize <= 5; pageSize++ {
+		if received := testPages(t, 0, pageSize); len(received) != 5 {
+			t.Errorf("pages of %d: received %d items, expected 5", pageSize, len(received))
+		}
+	}
+}
+
+// testPushConcurrently pushes changes through handle when locked, or straight
+// to syncItems otherwise, and returns false when the server was too busy
+func testPushConcurrently(t *testing.T, changes []Item, locked bool) bool {
+	r := testRequest(t, "alice", "token", protocolVersion, changes, 0)
+	if locked {
+		w := testServe(r)
+		if w.Code != 200 && w.Code != 503 {
+			t.Errorf("sync: %d %s", w.Code, w.Body.String())
+		}
+		return w.Code != 503
+	}
+
+	busy := false
+	func() {
+		defer func() {
+			if err := recover(); err == errConflict {
+				busy = true
+			} else if err != nil {
+				t.Errorf("sync: %v", err)
+			}
+		}()
+		retryOnConflict(func() {
+			syncItems(r, "alice", append([]Item{}, changes...), 0, maxPageSize, true)
+		})
+	}()
+	return !busy
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Clients send the protocol version they speak in the "protocol" header,
+// clients from before it was versioned send none and are version 1. Version 2
+// adds json bodies, sent with a Content-Type of application/json and answered
+// in kind, see the readme for their format. Bodies are gob otherwise. Version
+// 3 clients only send sealed items.
+const (
+	protocolVersion    = 3
+	minProtocolVersion = 1
+	protocolSealed     = 3
+)
+
+// jsonItem is how items are sent as json, ids and revs as strings as they
+// don't fit in a float64 and data as base64, it holds Item.Sealed for
+// clients speaking protocolSealed and Item.Data for older ones
+type jsonItem struct {
+	ID   int64  `json:"id,string"`
+	Rev  int64  `json:"rev,string"`
+	Data []byte `json:"data"`
+}
+
+// withProtocol rejects clients speaking a protocol version we don't, and
+// limits the size of request bodies
+func withProtocol(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("protocol", strconv.Itoa(protocolVersion))
+		version := minProtocolVersion
+		if v := r.Header.Get("protocol"); v != "" {
+			var err error
+			if version, err = strconv.Atoi(v); err != nil {
+				version = -1
+			}
+		}
+		if version < minProtocolVersion || version > protocolVersion {
+			writeError(w, httpError{426, "unsupported_protocol", fmt.Sprintf(
+				"unsupported protocol version %s, this server speaks versions %d to %d",
+				r.Header.Get("protocol"), minProtocolVersion, protocolVersion)})
+			return
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, maxBodySize)
+		h(w, r)
+	}
+}
+
+// protocolOf returns the protocol version of a request withProtocol accepted
+func protocolOf(r *http.Request) int {
+	if version, err := strconv.Atoi(r.Header.Get("protocol")); err == nil {
+		return version
+	}
+	return minProtocolVersion
+}
+
+func isJSON(r *http.Request) bool {
+	return strings.HasPrefix(r.Header.Get("Content-Type"), "application/json")
+}
+
+// readBody decodes the request's body into v
+func readBody(r *http.Request, v interface{}) {
+	var err error
+	if isJSON(r) {
+		err = json.NewDecoder(r.Body).Decode(v)
+	} else {
+		err = gob.NewDecoder(r.Body).Decode(v)
+	}
+	if err != nil && err.Error() == "http: request body too large" {
+		panic(httpError{413, "body_too_large", fmt.Sprintf("requests can't be larger than %d bytes", maxBodySize)})
+	} else if err != nil {
+		panic(httpError{400, "invalid_body", "invalid body: " + err.Error()})
+	}
+}
+
+// writeBody encodes v as the response's body, in the request's encoding
+func writeBody(w http.ResponseWriter, r *http.Request, v interface{}) {
+	if isJSON(r) {
+		w.Header().Set("Content-Type", "application/json")
+		check(json.NewEncoder(w).Encode(v))
+		return
+	}
+	check(gob.NewEncoder(w).Encode(v))
+}
+
+func readItems(r *http.Request) []Item {
+	if !isJSON(r) {
+		items := []Item{}
+		readBody(r, &items)
+		return items
+	}
+	jsonItems := []jsonItem{}
+	readBody(r, &jsonItems)
+	items := make([]Item, len(jsonItems))
+	for n, i := range jsonItems {
+		items[n] = Item{ID: i.ID, Rev: i.Rev, Sealed: i.Data}
+		if protocolOf(r) < protocolSealed {
+			items[n] = Item{ID: i.ID, Rev: i.Rev, Data: string(i.Data)}
+		}
+	}
+	return items
+}
+
+func writeItems(w http.ResponseWriter, r *http.Request, items []Item) {
+	if !isJSON(r) {
+		writeBody(w, r, items)
+		return
+	}
+	jsonItems := make([]jsonItem, len(items))
+	for n, i := range items {
+		jsonItems[n] = jsonItem{ID: i.ID, Rev: i.Rev, Data: i.Sealed}
+		if protocolOf(r) < protocolSealed {
+			jsonItems[n].Data = []byte(i.Data)
+		}
+	}
+	writeBody(w, r, jsonItems)
+}
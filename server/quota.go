@@ -0,0 +1,171 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// quotas on what a user can store, 0 for no limit, items being the
+// revisions kept in the user's chunks, fewer once compacted. A user at a
+// quota can still edit and delete notes, see quotaExceededLatest.
+var (
+	quotaItems     int64
+	quotaBytes     int64
+	quotaBlobBytes int64
+)
+
+// Usage is what a user stores, next to their quotas
+type Usage struct {
+	Items        int64 `json:"items"`
+	Bytes        int64 `json:"bytes"`
+	Blobs        int   `json:"blobs"`
+	BlobBytes    int64 `json:"blobBytes"`
+	MaxItems     int64 `json:"maxItems"`
+	MaxBytes     int64 `json:"maxBytes"`
+	MaxBlobBytes int64 `json:"maxBlobBytes"`
+}
+
+// handleUsage answers the authenticated user's Usage
+func handleUsage(w http.ResponseWriter, r *http.Request) {
+	defer handleErrors(w, r)
+	defer r.Body.Close()
+	userHash := r.Header.Get("userhash")
+	if !userHashRe.MatchString(userHash) {
+		panic(httpError{400, "invalid_userhash", "invalid userhash"})
+	}
+
+	unlock := lockUser(userHash)
+	defer unlock()
+	usage := Usage{}
+	retryOnConflict(func() {
+		metadata := Metadata{}
+		storeGetMetadata(userHash, &metadata)
+		authenticate(r, &metadata)
+		if !metadata.Counted {
+			countItems(&metadata)
+			storePutMetadata(&metadata)
+		}
+		usage = Usage{metadata.Items, metadata.ItemBytes, len(metadata.Blobs), metadata.BlobBytes + metadata.uploadBytes(""),
+			quotaItems, quotaBytes, quotaBlobBytes}
+	})
+	writeBody(w, r, usage)
+}
+
+// countItems counts the items in the user's chunks, for accounts created
+// before items were counted as they're stored
+func countItems(metadata *Metadata) {
+	metadata.Items, metadata.ItemBytes = 0, 0
+	for n := range metadata.Chunks {
+		chunkItems := []Item{}
+		storeGetItems(metadata.chunkKey(n), &chunkItems)
+		for _, i := range chunkItems {
+			metadata.Items++
+			metadata.ItemBytes += i.size()
+		}
+	}
+	metadata.Counted = true
+}
+
+// indexRevs builds the user's Revs from their chunks
+func indexRevs(metadata *Metadata) Revs {
+	revs := Revs{}
+	for n := range metadata.Chunks {
+		chunkItems := []Item{}
+		storeGetItems(metadata.chunkKey(n), &chunkItems)
+		for _, i := range chunkItems {
+			revs.add(i)
+		}
+	}
+	return revs
+}
+
+func (i Item) size() int64 {
+	return int64(len(i.Data) + len(i.Sealed))
+}
+
+// quotaExceeded describes the quota storing items and bytes more would take
+// the user past, empty when there's room
+func quotaExceeded(metadata *Metadata, items, bytes int64) string {
+	if quotaItems > 0 && items > 0 && metadata.Items+items > quotaItems {
+		return fmt.Sprintf("%d items", quotaItems)
+	} else if quotaBytes > 0 && bytes > 0 && metadata.ItemBytes+bytes > quotaBytes {
+		return fmt.Sprintf("%d bytes of notes", quotaBytes)
+	}
+	return ""
+}
+
+// quotaExceededLatest is quotaExceeded counting only the latest revision of
+// every item, what compaction eventually keeps, so revisions of items already
+// stored count by how much they grow and edits and deletions let users get
+// back under a quota. It reads all the chunks, and is only worth it once the
+// plain count is over.
+func quotaExceededLatest(metadata *Metadata, changes []Item) string {
+	latest := map[int64]Item{}
+	for n := range metadata.Chunks {
+		chunkItems := []Item{}
+		storeGetItems(metadata.chunkKey(n), &chunkItems)
+		for _, i := range chunkItems {
+			if l, ok := latest[i.ID]; !ok || i.Rev >= l.Rev {
+				latest[i.ID] = i
+			}
+		}
+	}
+	kept := Metadata{}
+	for _, i := range latest {
+		kept.Items++
+		kept.ItemBytes += i.size()
+	}
+	items, bytes := int64(0), int64(0)
+	for _, i := range changes {
+		l, ok := latest[i.ID]
+		if !ok {
+			items++
+			bytes += i.size()
+			latest[i.ID] = i
+		} else if i.Rev >= l.Rev {
+			bytes += i.size() - l.size()
+			latest[i.ID] = i
+		}
+	}
+	return quotaExceeded(&kept, items, bytes)
+}
+
+func quotaError(limit string) httpError {
+	return httpError{507, "quota_exceeded", "this account can't store more than " + limit + ", delete notes or attachments"}
+}
+
+// parseSize reads a number of bytes, with an optional KB, MB or GB suffix
+func parseSize(s string) (int64, error) {
+	s = strings.ToUpper(strings.TrimSpace(s))
+	unit := int64(1)
+	for suffix, n := range map[string]int64{"KB": 1 << 10, "MB": 1 << 20, "GB": 1 << 30} {
+		if strings.HasSuffix(s, suffix) {
+			s, unit = strings.TrimSpace(strings.TrimSuffix(s, suffix)), n
+		}
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return n * unit, nil
+}
+
+// sizeFlag is a flag taking a size, see parseSize
+type sizeFlag struct{ v *int64 }
+
+func (f sizeFlag) String() string {
+	if f.v == nil {
+		return "0"
+	}
+	return strconv.FormatInt(*f.v, 10)
+}
+
+func (f sizeFlag) Set(s string) error {
+	n, err := parseSize(s)
+	if err == nil {
+		*f.v = n
+	}
+	return err
+}
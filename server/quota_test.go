@@ -0,0 +1,45 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// testPush pushes changes sealed and returns the status the server answered
+func testPush(t *testing.T, changes []Item) int {
+	t.Helper()
+	return testServe(testRequest(t, "alice", "token", protocolSealed, changes, 0)).Code
+}
+
+func TestQuotaEditsAndDeletes(t *testing.T) {
+	defer func(items, bytes int64) { quotaItems, quotaBytes = items, bytes }(quotaItems, quotaBytes)
+	quotaItems, quotaBytes = 3, 300
+	testAccount(t, "alice", "token")
+
+	note := func(id, rev int64, size int) Item {
+		return Item{ID: id, Rev: rev, Sealed: []byte(strings.Repeat("x", size))}
+	}
+	if code := testPush(t, []Item{note(1, 1, 90), note(2, 2, 90), note(3, 3, 90)}); code != 200 {
+		t.Fatalf("pushing notes under the quotas: %d", code)
+	}
+	if code := testPush(t, []Item{note(4, 4, 10)}); code != 507 {
+		t.Errorf("pushing a note past the item quota: %d", code)
+	}
+	if code := testPush(t, []Item{note(1, 5, 200)}); code != 507 {
+		t.Errorf("growing a note past the byte quota: %d", code)
+	}
+	if code := testPush(t, []Item{note(1, 6, 95), note(2, 7, 80)}); code != 200 {
+		t.Errorf("editing notes within the quotas: %d", code)
+	}
+	// tombstones are as small as sealing nothing gets
+	if code := testPush(t, []Item{note(3, 8, 28)}); code != 200 {
+		t.Errorf("deleting a note: %d", code)
+	}
+
+	// the stored revisions are counted until compaction drops the superseded
+	metadata := Metadata{}
+	storeGetMetadata("alice", &metadata)
+	if metadata.Items != 6 {
+		t.Errorf("counted %d items, expected 6", metadata.Items)
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"math/big"
+)
+
+// SRP-6a (RFC 5054) with the 2048-bit group and SHA-256, the client side
+// lives in the app's srp.go and srp_client.go and must stay in step with this
+// file, the tests log in with the latter
+
+var srpN, _ = new(big.Int).SetString(""+
+	"AC6BDB41324A9A9BF166DE5E1389582FAF72B6651987EE07FC3192943DB56050"+
+	"A37329CBB4A099ED8193E0757767A13DD52312AB4B03310DCD7F48A9DA04FD50"+
+	"E8083969EDB767B0CF6095179A163AB3661A05FBD5FAAAE82918A9962F0B93B8"+
+	"55F97993EC975EEAA80D740ADBF4FF747359D041D5C33EA71D281E446B14773B"+
+	"CA97B43A23FB801676BD207A436C6481F1D2B9078717461A5B9D32E688F87748"+
+	"544523B524B0D57D5EA77A2775D2ECFA032CFBDBF52FB3786160279004E57AE6"+
+	"AF874E7303CE53299CCC041C7BC308D82A5698F3A8D0C38271AE35F8E9DBFBB6"+
+	"94B5C803D89F7AE435DE236D525F54759B65E372FCD68EF20FA7111F9E4AFF73", 16)
+var srpG = big.NewInt(2)
+var srpK = srpHashInt(srpPad(srpN), srpPad(srpG))
+
+func srpHash(parts ...[]byte) []byte {
+	h := sha256.New()
+	for _, p := range parts {
+		h.Write(p)
+	}
+	return h.Sum(nil)
+}
+
+func srpHashInt(parts ...[]byte) *big.Int {
+	return new(big.Int).SetBytes(srpHash(parts...))
+}
+
+func srpPad(n *big.Int) []byte {
+	return n.FillBytes(make([]byte, (srpN.BitLen()+7)/8))
+}
+
+type srpServer struct {
+	A *big.Int
+	B *big.Int
+	K []byte
+}
+
+// srpServerStart answers a client's A with B given the user's verifier, it
+// returns nil when A is invalid, A must be in the group for srpPad to fit it
+func srpServerStart(verifier []byte, A []byte) *srpServer {
+	s := &srpServer{A: new(big.Int).SetBytes(A)}
+	if s.A.Sign() == 0 || s.A.Cmp(srpN) >= 0 || new(big.Int).Mod(s.A, srpN).Sign() == 0 {
+		return nil
+	}
+	v := new(big.Int).SetBytes(verifier)
+	bs := make([]byte, 32)
+	_, err := rand.Read(bs)
+	check(err)
+	b := new(big.Int).SetBytes(bs)
+	s.B = new(big.Int).Exp(srpG, b, srpN)
+	s.B.Add(s.B, new(big.Int).Mul(srpK, v))
+	s.B.Mod(s.B, srpN)
+	u := srpHashInt(srpPad(s.A), srpPad(s.B))
+	if u.Sign() == 0 {
+		return nil
+	}
+	S := new(big.Int).Exp(v, u, srpN)
+	S.Mul(S, s.A)
+	S.Exp(S, b, srpN)
+	s.K = srpHash(srpPad(S))
+	return s
+}
+
+// verify checks the client's proof and returns the server's proof, or nil
+// when the client doesn't know the password
+func (s *srpServer) verify(proof []byte) []byte {
+	expected := srpHash(srpPad(s.A), srpPad(s.B), s.K)
+	if subtle.ConstantTimeCompare(expected, proof) != 1 {
+		return nil
+	}
+	return srpHash(srpPad(s.A), proof, s.K)
+}
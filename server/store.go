@@ -0,0 +1,291 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// Store holds the server's objects by key, "<userhash>/_meta" for metadata,
+// "<userhash>/_revs" for their Revs and "<userhash>/<n>" for chunks of items.
+// Get returns an object along with its version, both empty for missing keys.
+// Put only writes an object still at the given version, "" meaning it must
+// not exist yet, returning its new version, or errConflict when someone else
+// wrote it in the meantime. Deleting a missing key isn't an error.
+type Store interface {
+	Get(key string) (data []byte, version string, err error)
+	Put(key string, data []byte, version string) (string, error)
+	Delete(key string) error
+}
+
+var errConflict = errors.New("store: version conflict")
+
+// newStore opens the store of the given kind, path being its bucket for s3,
+// its directory for fs and its database file for sqlite
+func newStore(kind, path string) (Store, error) {
+	switch kind {
+	case "s3":
+		return newS3Store(path), nil
+	case "fs":
+		return newFSStore(path)
+	case "sqlite":
+		return newSQLiteStore(path)
+	case "memory":
+		return newMemoryStore(), nil
+	}
+	return nil, fmt.Errorf("unknown store: %s", kind)
+}
+
+type s3Store struct {
+	client *s3.S3
+	bucket string
+}
+
+func newS3Store(bucket string) *s3Store {
+	config := &aws.Config{}
+	config.Region = aws.String("us-east-1")
+	config.Credentials = credentials.NewStaticCredentials(
+		os.Getenv("AWS_ACCESS_KEY"), os.Getenv("AWS_SECRET_KEY"), "")
+	s3Session := session.Must(session.NewSession(config))
+	return &s3Store{s3.New(s3Session), bucket}
+}
+
+// Get uses the object's ETag as its version
+func (s *s3Store) Get(key string) ([]byte, string, error) {
+	result, err := s.client.GetObject(&s3.GetObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+	})
+	if aerr, ok := err.(awserr.Error); ok && aerr.Code() == s3.ErrCodeNoSuchKey {
+		return []byte{}, "", nil
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	defer result.Body.Close()
+	bs, err := ioutil.ReadAll(result.Body)
+	return bs, aws.StringValue(result.ETag), err
+}
+
+// Put relies on s3's conditional writes, this sdk version doesn't know about
+// them so the headers are set by hand
+func (s *s3Store) Put(key string, data []byte, version string) (string, error) {
+	req, out := s.client.PutObjectRequest(&s3.PutObjectInput{
+		ACL:    aws.String("private"),
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+		Body:   bytes.NewReader(data),
+	})
+	if version == "" {
+		req.HTTPRequest.Header.Set("If-None-Match", "*")
+	} else {
+		req.HTTPRequest.Header.Set("If-Match", version)
+	}
+	err := req.Send()
+	if rerr, ok := err.(awserr.RequestFailure); ok && (rerr.StatusCode() == 412 || rerr.StatusCode() == 409) {
+		return "", errConflict
+	}
+	if err != nil {
+		return "", err
+	}
+	return aws.StringValue(out.ETag), nil
+}
+
+func (s *s3Store) Delete(key string) error {
+	_, err := s.client.DeleteObject(&s3.DeleteObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+	})
+	return err
+}
+
+// fsStore versions objects by the hash of their content, conditional writes
+// are only safe between the goroutines of a single process
+type fsStore struct {
+	lock sync.Mutex
+	dir  string
+}
+
+func newFSStore(dir string) (*fsStore, error) {
+	if dir == "" {
+		return nil, fmt.Errorf("fs store: no directory given")
+	}
+	return &fsStore{dir: dir}, os.MkdirAll(dir, 0700)
+}
+
+func (s *fsStore) path(key string) string {
+	return filepath.Join(s.dir, filepath.FromSlash(filepath.Clean("/"+key)))
+}
+
+func (s *fsStore) version(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func (s *fsStore) Get(key string) ([]byte, string, error) {
+	bs, err := ioutil.ReadFile(s.path(key))
+	if os.IsNotExist(err) {
+		return []byte{}, "", nil
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	return bs, s.version(bs), nil
+}
+
+// Put writes to a temporary file first so readers never see half an object
+func (s *fsStore) Put(key string, data []byte, version string) (string, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	_, current, err := s.Get(key)
+	if err != nil {
+		return "", err
+	}
+	if current != version {
+		return "", errConflict
+	}
+
+	path := s.path(key)
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return "", err
+	}
+	f, err := ioutil.TempFile(filepath.Dir(path), ".tmp-")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return "", err
+	}
+	if err := f.Close(); err != nil {
+		return "", err
+	}
+	return s.version(data), os.Rename(f.Name(), path)
+}
+
+func (s *fsStore) Delete(key string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	err := os.Remove(s.path(key))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+type sqliteStore struct {
+	db *sql.DB
+}
+
+func newSQLiteStore(path string) (*sqliteStore, error) {
+	if path == "" {
+		return nil, fmt.Errorf("sqlite store: no database given")
+	}
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		return nil, err
+	}
+	db.SetMaxOpenConns(1)
+	_, err = db.Exec("create table if not exists objects (key text primary key, data blob, version int not null default 1);")
+	return &sqliteStore{db}, err
+}
+
+func (s *sqliteStore) Get(key string) ([]byte, string, error) {
+	bs := []byte{}
+	var version int64
+	err := s.db.QueryRow("select data, version from objects where key = ?;", key).Scan(&bs, &version)
+	if err == sql.ErrNoRows {
+		return []byte{}, "", nil
+	}
+	return bs, strconv.FormatInt(version, 10), err
+}
+
+func (s *sqliteStore) Put(key string, data []byte, version string) (string, error) {
+	if version == "" {
+		res, err := s.db.Exec("insert into objects (key, data, version) values (?, ?, 1) on conflict (key) do nothing;", key, data)
+		return "1", sqliteConflict(res, err)
+	}
+	current, err := strconv.ParseInt(version, 10, 64)
+	if err != nil {
+		return "", err
+	}
+	res, err := s.db.Exec("update objects set data = ?, version = version + 1 where key = ? and version = ?;", data, key, current)
+	return strconv.FormatInt(current+1, 10), sqliteConflict(res, err)
+}
+
+// sqliteConflict turns a write that changed no row into errConflict
+func sqliteConflict(res sql.Result, err error) error {
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return errConflict
+	}
+	return nil
+}
+
+func (s *sqliteStore) Delete(key string) error {
+	_, err := s.db.Exec("delete from objects where key = ?;", key)
+	return err
+}
+
+// memoryStore keeps everything in memory, for tests and throwaway servers
+type memoryStore struct {
+	lock     sync.Mutex
+	objects  map[string][]byte
+	versions map[string]int
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{objects: map[string][]byte{}, versions: map[string]int{}}
+}
+
+func (s *memoryStore) version(key string) string {
+	if v, ok := s.versions[key]; ok {
+		return strconv.Itoa(v)
+	}
+	return ""
+}
+
+func (s *memoryStore) Get(key string) ([]byte, string, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return append([]byte{}, s.objects[key]...), s.version(key), nil
+}
+
+func (s *memoryStore) Put(key string, data []byte, version string) (string, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.version(key) != version {
+		return "", errConflict
+	}
+	s.objects[key] = append([]byte{}, data...)
+	s.versions[key]++
+	return s.version(key), nil
+}
+
+func (s *memoryStore) Delete(key string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	delete(s.objects, key)
+	delete(s.versions, key)
+	return nil
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"errors"
+	"math/big"
+)
+
+// The client side of srp, see srp.go. The server's tests log in with this
+// very file, copied to server/srp_client_test.go, so it only depends on what
+// both sides define.
+
+// srpVerifier is what the server stores in place of a password, secret being
+// the already stretched authKey
+func srpVerifier(salt, secret []byte) []byte {
+	x := srpHashInt(salt, secret)
+	return new(big.Int).Exp(srpG, x, srpN).Bytes()
+}
+
+type srpClient struct {
+	a *big.Int
+	A *big.Int
+	M []byte
+	K []byte
+}
+
+func srpClientStart() *srpClient {
+	bs := make([]byte, 32)
+	_, err := rand.Read(bs)
+	check(err)
+	c := &srpClient{a: new(big.Int).SetBytes(bs)}
+	c.A = new(big.Int).Exp(srpG, c.a, srpN)
+	return c
+}
+
+// proof answers the server's challenge with the client's proof of the password
+func (c *srpClient) proof(salt, secret, B []byte) ([]byte, error) {
+	b := new(big.Int).SetBytes(B)
+	if new(big.Int).Mod(b, srpN).Sign() == 0 {
+		return nil, errors.New("srp: invalid server value")
+	}
+	u := srpHashInt(srpPad(c.A), srpPad(b))
+	if u.Sign() == 0 {
+		return nil, errors.New("srp: invalid server value")
+	}
+	x := srpHashInt(salt, secret)
+	S := new(big.Int).Exp(srpG, x, srpN)
+	S.Mul(S, srpK)
+	S.Sub(b, S)
+	S.Mod(S, srpN)
+	S.Exp(S, new(big.Int).Add(c.a, new(big.Int).Mul(u, x)), srpN)
+	c.K = srpHash(srpPad(S))
+	c.M = srpHash(srpPad(c.A), srpPad(b), c.K)
+	return c.M, nil
+}
+
+// verify checks the server's proof, so we know it holds our verifier
+func (c *srpClient) verify(proof []byte) bool {
+	expected := srpHash(srpPad(c.A), c.M, c.K)
+	return subtle.ConstantTimeCompare(expected, proof) == 1
+}
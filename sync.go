@@ -0,0 +1,902 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/gob"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	mathrand "math/rand"
+	"net"
+	"net/http"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// syncItem is an Item as sent to the server, sealed with a key derived from
+// the password so the server can't read it, ID and Rev stay in clear for it
+// to order them. Data is only set by versions before syncSealed.
+type syncItem struct {
+	ID     int64
+	Rev    int64
+	Data   string
+	Sealed []byte
+}
+
+type LoginRequest struct {
+	UserHash    string
+	A           []byte
+	HandshakeID string
+	Proof       []byte
+	DeviceID    string
+	DeviceName  string
+}
+
+type LoginResponse struct {
+	Enroll      bool
+	Legacy      bool
+	HandshakeID string
+	Salt        []byte
+	B           []byte
+	Proof       []byte
+	Token       string
+	Expires     int64
+}
+
+type EnrollRequest struct {
+	UserHash string
+	PassKey  []byte
+	Salt     []byte
+	Verifier []byte
+}
+
+type SignupRequest struct {
+	UserHash string
+	Salt     []byte
+	Verifier []byte
+	Invite   string
+}
+
+type DevicesRequest struct {
+	Revoke string
+}
+
+type Device struct {
+	ID       string
+	Name     string
+	Created  int64
+	LastSeen int64
+	Expires  int64
+	Revoked  bool
+}
+
+// Usage is what our account stores on the server, with its quotas, 0 for
+// no limit
+type Usage struct {
+	Items        int64
+	Bytes        int64
+	Blobs        int
+	BlobBytes    int64
+	MaxItems     int64
+	MaxBytes     int64
+	MaxBlobBytes int64
+}
+
+// syncStatusError is returned when the server answers with a non 2xx status,
+// Kind is the error code servers send along since protocol version 2
+type syncStatusError struct {
+	Code    int
+	Kind    string
+	Message string
+}
+
+// syncErrorMessages explains the server's errors to users
+var syncErrorMessages = map[string]string{
+	"wrong_password":       "the server didn't accept your password",
+	"account_not_found":    "account not found, check the username or create an account",
+	"account_exists":       "an account with this username already exists",
+	"registration_closed":  "this server doesn't take new accounts",
+	"invite_required":      "this server needs an invite to create an account",
+	"invalid_invite":       "this invite is invalid or was used already",
+	"invalid_session":      "your session expired, logging in again",
+	"login_required":       "this account needs to log in again",
+	"device_revoked":       "this device was revoked from another device",
+	"handshake_expired":    "logging in took too long, try again",
+	"unsupported_protocol": "this version of nervos is too old or too new for the server",
+	"sealed_account":       "update nervos to keep syncing this account",
+	"too_many_items":       "too many changes were sent at once",
+	"item_too_large":       "a note is too large to sync",
+	"body_too_large":       "too much was sent at once",
+	"quota_exceeded":       "your account is out of space",
+	"busy":                 "the server is busy, try again later",
+}
+
+func (e syncStatusError) Error() string {
+	if message, ok := syncErrorMessages[e.Kind]; ok {
+		return message
+	}
+	if e.Message != "" {
+		return fmt.Sprintf("server error %d: %s", e.Code, e.Message)
+	}
+	return fmt.Sprintf("server error %d", e.Code)
+}
+
+// syncReadError turns an error response into a syncStatusError, servers
+// before protocol version 2 answered with a plain text message
+func syncReadError(res *http.Response) error {
+	body, _ := ioutil.ReadAll(io.LimitReader(res.Body, 4096))
+	e := syncStatusError{Code: res.StatusCode, Message: strings.TrimSpace(string(body))}
+	if strings.HasPrefix(res.Header.Get("Content-Type"), "application/json") {
+		v := struct{ Error, Message string }{}
+		if json.Unmarshal(body, &v) == nil {
+			e.Kind, e.Message = v.Error, v.Message
+		}
+	}
+	return e
+}
+
+var (
+	sessionToken   string
+	sessionExpires time.Time
+	// syncPageSize is how many items we ask the server for at once, which it
+	// lowers to its own page size, NERVOS_PAGE_SIZE changes it
+	syncPageSize = envInt("NERVOS_PAGE_SIZE", 500)
+	syncPushSize = 500
+	syncProgress string
+	// syncNow asks the sync loop not to wait for its next poll
+	syncNow = make(chan struct{}, 1)
+	// syncListening is true while the server streams us events, layoutLock
+	// must be held
+	syncListening bool
+	// syncStatus is one of the sync* constants below, syncError the message
+	// of the last failed sync, layoutLock must be held for both
+	syncStatus = syncSyncing
+	syncError  string
+	// syncInterval is how often we poll when all is well and the server isn't
+	// pushing us events
+	syncInterval = 30 * time.Second
+	syncFailures int
+	// syncEventsTimeout is how long the event stream may stay silent, twice
+	// the server's keep-alive, before we take it as dead and poll instead
+	syncEventsTimeout = time.Minute
+)
+
+const (
+	syncSynced  = "synced"
+	syncSyncing = "syncing"
+	syncOffline = "offline"
+	syncFailed  = "error"
+)
+
+// syncRun runs syncChanges, keeping the status shown in the search bar up to
+// date, and returns how long to wait before the next sync, backing off after
+// failures. Network failures are retried sooner than server ones so sync
+// resumes quickly when the network returns, auth failures lock the app
+// until the password is entered again, or send it back to the login page
+// when the server doesn't know the account.
+func syncRun() time.Duration {
+	syncSetStatus(syncSyncing, "")
+	err := syncChanges()
+	if err != nil && syncErrorKind(err) == "auth" {
+		// our session may just have expired, in which case logging in again works
+		err = syncChanges()
+	}
+	if err == nil {
+		syncFailures = 0
+		syncSetStatus(syncSynced, "")
+		return syncInterval
+	}
+
+	kind := syncErrorKind(err)
+	log.Println("error syncing:", kind, err)
+	syncFailures++
+	switch kind {
+	case "network":
+		syncSetStatus(syncOffline, err.Error())
+		return syncBackoff(syncFailures, 2*time.Second, time.Minute)
+	case "auth":
+		syncFailures = 0
+		syncSetStatus(syncFailed, err.Error())
+		var statusErr syncStatusError
+		if errors.As(err, &statusErr) && statusErr.Kind == "account_not_found" {
+			updateLogout("sync login failed: " + err.Error())
+		} else {
+			updateLock("sync login failed: " + err.Error())
+		}
+		return time.Second
+	}
+	syncSetStatus(syncFailed, err.Error())
+	return syncBackoff(syncFailures, syncInterval, 15*time.Minute)
+}
+
+// syncErrorKind classifies a sync failure as "network", "auth", "server" or
+// "decode"
+func syncErrorKind(err error) string {
+	var netErr net.Error
+	var statusErr syncStatusError
+	if errors.As(err, &netErr) {
+		return "network"
+	} else if errors.As(err, &statusErr) && (statusErr.Code == 401 || statusErr.Code == 403 || statusErr.Kind == "account_not_found") {
+		return "auth"
+	} else if errors.As(err, &statusErr) {
+		return "server"
+	}
+	return "decode"
+}
+
+// syncBackoff doubles base for every failure after the first, up to max,
+// give or take a fifth so devices don't all retry at once
+func syncBackoff(failures int, base, max time.Duration) time.Duration {
+	d := base
+	for i := 1; i < failures && d < max; i++ {
+		d *= 2
+	}
+	if d > max {
+		d = max
+	}
+	return d + time.Duration((mathrand.Float64()*0.4-0.2)*float64(d))
+}
+
+func syncSetStatus(status, message string) {
+	layoutLock.Lock()
+	syncStatus = status
+	syncError = message
+	if status != syncSyncing {
+		syncProgress = ""
+	}
+	layoutLock.Unlock()
+	invalidate()
+}
+
+// syncPending counts the local changes the server doesn't have yet
+func syncPending() int {
+	pending := 0
+	for _, i := range items {
+		if i.Rev > settings.LastSync {
+			pending++
+		}
+	}
+	return pending
+}
+
+// syncStatusGlyph is the search bar's sync indicator, layoutLock must be held
+func syncStatusGlyph() string {
+	switch syncStatus {
+	case syncSyncing:
+		return "↻"
+	case syncOffline:
+		return "×"
+	case syncFailed:
+		return "!"
+	}
+	return "✓"
+}
+
+// syncStatusText describes the sync status in a sentence, layoutLock must be
+// held
+func syncStatusText() string {
+	last := "never synced"
+	if settings.LastSyncTime > 0 {
+		last = "last synced " + time.Unix(settings.LastSyncTime, 0).Format("2006-01-02 15:04")
+	}
+	pending := fmt.Sprintf("%d local changes pending", syncPending())
+	switch syncStatus {
+	case syncSyncing:
+		return "Syncing... " + last
+	case syncOffline:
+		return "Offline, " + last + ", " + pending
+	case syncFailed:
+		return "Sync error: " + syncError + ", " + last + ", " + pending
+	}
+	return "Synced, " + last + ", " + pending
+}
+
+func syncChanges() error {
+	if sessionToken == "" || time.Now().Add(time.Minute).After(sessionExpires) {
+		if err := syncLogin(); err != nil {
+			return err
+		}
+	}
+
+	changes := []syncItem{}
+	for _, i := range itemsSnapshot() {
+		// send everything again sealed if we used to send notes in clear
+		if i.Rev > settings.LastSync || settings.Version < formatSyncSealed {
+			changes = append(changes, syncSeal(&i))
+		}
+	}
+	// changes are pushed syncPushSize at a time, LastSync only moves once
+	// they are all on the server so a failure midway doesn't lose any
+	checkpoint := settings.LastSync
+	received := 0
+	for {
+		batch := changes[:min(len(changes), syncPushSize)]
+		changes = changes[len(batch):]
+		headers := syncHeaders()
+		headers["checkpoint"] = strconv.FormatInt(checkpoint, 10)
+		headers["pagesize"] = strconv.Itoa(syncPageSize)
+		if settings.Version < formatSyncSealed && len(changes) == 0 {
+			// the server drops the notes sent in clear once they're all
+			// sealed there, not before
+			headers["resealed"] = "true"
+		}
+		res, err := syncRequest("/", batch, headers)
+		if err != nil {
+			return err
+		}
+		sealedUpdates := []syncItem{}
+		err = gob.NewDecoder(res.Body).Decode(&sealedUpdates)
+		res.Body.Close()
+		if err != nil {
+			return err
+		}
+		updates := []Item{}
+		for _, si := range sealedUpdates {
+			i, err := syncUnseal(si)
+			if err == errUnsealedItem {
+				// not moving past it, the sealed copy comes at the same rev
+				return err
+			} else if err != nil {
+				log.Println("skipping update:", si.ID, si.Rev, err)
+				continue
+			}
+			updates = append(updates, i)
+		}
+		syncApply(updates)
+		checkpoint, err = strconv.ParseInt(res.Header.Get("checkpoint"), 10, 64)
+		if err != nil {
+			return err
+		}
+		more := res.Header.Get("more") == "true"
+		done := !more && len(changes) == 0
+		if len(changes) == 0 {
+			settings.LastSync = checkpoint
+		}
+		if done {
+			settings.LastSyncTime = time.Now().Unix()
+			if settings.Version < formatSyncSealed {
+				settings.Version = formatSyncSealed
+			}
+		}
+		settingsSave(dataKey, settings)
+		log.Printf("synced %d changes, %d updates", len(batch), len(updates))
+
+		received += len(updates)
+		layoutLock.Lock()
+		syncProgress = ""
+		if !done {
+			syncProgress = fmt.Sprintf("Syncing... %d notes received, %d changes left to send", received, len(changes))
+		}
+		if page == "search" {
+			updateSearchResults()
+		}
+		layoutLock.Unlock()
+		invalidate()
+		if done {
+			return syncBlobs()
+		}
+	}
+}
+
+// envInt reads a positive number from the environment, def when unset or
+// invalid
+func envInt(name string, def int) int {
+	if n, err := strconv.Atoi(os.Getenv(name)); err == nil && n > 0 {
+		return n
+	}
+	return def
+}
+
+// syncLater wakes the sync loop up, unless a sync is already due
+func syncLater() {
+	select {
+	case syncNow <- struct{}{}:
+	default:
+	}
+}
+
+// syncListen keeps an event stream open with the server and syncs as soon as
+// another device pushed changes, the sync loop keeps polling when it's down
+func syncListen() {
+	failures := 0
+	for {
+		if len(dataKey) == 0 || sessionToken == "" {
+			time.Sleep(time.Second)
+			continue
+		}
+		start := time.Now()
+		err := syncEvents()
+		layoutLock.Lock()
+		syncListening = false
+		layoutLock.Unlock()
+		log.Println("event stream closed:", err)
+		if time.Since(start) > time.Minute {
+			failures = 0
+		}
+		failures++
+		time.Sleep(syncBackoff(failures, 2*time.Second, time.Minute))
+	}
+}
+
+var errEventsTimeout = errors.New("event stream silent for too long")
+
+func syncEvents() error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	// a connection dropped without a word, such as when the network changes,
+	// would otherwise keep us reading forever while no sync is pushed to us
+	timedOut := false
+	deadline := time.AfterFunc(syncEventsTimeout, func() {
+		layoutLock.Lock()
+		timedOut = true
+		layoutLock.Unlock()
+		cancel()
+	})
+	defer deadline.Stop()
+	req, err := http.NewRequestWithContext(ctx, "GET", apiUrl+"/events", nil)
+	if err != nil {
+		return err
+	}
+	for k, v := range syncHeaders() {
+		req.Header.Set(k, v)
+	}
+	req.Header.Set("protocol", strconv.Itoa(syncProtocol))
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode == 401 {
+		sessionToken = ""
+	}
+	if res.StatusCode/100 != 2 {
+		return syncReadError(res)
+	}
+
+	layoutLock.Lock()
+	syncListening = true
+	layoutLock.Unlock()
+	// we may have missed changes while disconnected
+	syncLater()
+	scanner := bufio.NewScanner(res.Body)
+	for scanner.Scan() {
+		deadline.Reset(syncEventsTimeout)
+		if scanner.Text() == "event: changes" {
+			syncLater()
+		}
+	}
+	layoutLock.Lock()
+	defer layoutLock.Unlock()
+	if timedOut {
+		return errEventsTimeout
+	} else if err := scanner.Err(); err != nil {
+		return err
+	}
+	return io.EOF
+}
+
+// syncSeal seals an item for the server, binding it to its ID and Rev so it
+// can't be passed off as another item or revision
+func syncSeal(i *Item) syncItem {
+	return syncItem{ID: i.ID, Rev: i.Rev, Sealed: sealWith(subKey(dataKey, "sync"), []byte(i.Data), syncItemAD(i.ID, i.Rev))}
+}
+
+var errUnsealedItem = errors.New("the server sent a note in clear, open nervos on a device that has it to seal it first")
+
+// syncUnseal opens an item from the server, older versions sent them in
+// clear, which is only accepted until we sent ours sealed as afterwards only
+// the server could have written them. New databases never accept them, the
+// account's other devices seal them for us
+func syncUnseal(si syncItem) (Item, error) {
+	if len(si.Sealed) == 0 && settings.Version >= formatSyncSealed {
+		return Item{}, errUnsealedItem
+	} else if len(si.Sealed) == 0 {
+		return Item{ID: si.ID, Rev: si.Rev, Data: si.Data}, nil
+	}
+	data, err := unsealWith(subKey(dataKey, "sync"), si.Sealed, syncItemAD(si.ID, si.Rev))
+	return Item{ID: si.ID, Rev: si.Rev, Data: string(data)}, err
+}
+
+func syncItemAD(id, rev int64) []byte {
+	ad := make([]byte, 16)
+	binary.BigEndian.PutUint64(ad, uint64(id))
+	binary.BigEndian.PutUint64(ad[8:], uint64(rev))
+	return ad
+}
+
+func syncApply(updates []Item) {
+	layoutLock.Lock()
+	defer layoutLock.Unlock()
+	for _, remotei := range updates {
+		if locali, ok := items[remotei.ID]; ok {
+			if remotei.Rev > locali.Rev {
+				var ii = remotei
+				items[ii.ID] = &ii
+				itemsSave(dataKey, &ii)
+				if page == "note" && pageSubject.(*Item).ID == ii.ID {
+					noteEditor.SetText(ii.Data)
+				}
+			}
+		} else {
+			var ii = remotei
+			items[ii.ID] = &ii
+			itemsSave(dataKey, &ii)
+		}
+	}
+}
+
+type BlobsRequest struct {
+	IDs []string
+}
+
+type BlobsResponse struct {
+	Missing []string
+	Offsets map[string]int64
+}
+
+type BlobsCollectRequest struct {
+	Keep []string
+}
+
+type BlobsCollectResponse struct {
+	Deleted []string
+	Bytes   int64
+}
+
+// syncBlobPart is how much of a blob is sent per request, an interrupted
+// upload resumes from the last part the server got
+const syncBlobPart = 4 << 20
+
+// blobsCollected is when we last asked the server to delete the blobs no
+// note refers to, done at most once a day
+var blobsCollected time.Time
+
+// syncBlobs sends the attachments the server doesn't have, gets the ones
+// notes refer to that we don't have, and now and then deletes the ones no
+// note refers to anymore. The server is asked about every attachment notes
+// refer to, not only the ones we didn't send yet, as the device that attached
+// one may never have managed to, or the server lost it, and any device
+// having it sends it again.
+func syncBlobs() error {
+	referenced := syncBlobsReferenced()
+	local, err := attachmentIDs(false)
+	if err != nil {
+		return err
+	}
+	unsynced, err := attachmentIDs(true)
+	if err != nil {
+		return err
+	}
+	have := map[string]bool{}
+	for _, id := range local {
+		have[id] = true
+	}
+	ids := unsynced
+	asked := map[string]bool{}
+	for _, id := range unsynced {
+		asked[id] = true
+	}
+	for _, id := range referenced {
+		if !asked[id] {
+			asked[id] = true
+			ids = append(ids, id)
+		}
+	}
+
+	missing := map[string]bool{}
+	for len(ids) > 0 {
+		batch := ids
+		if len(batch) > 1000 {
+			batch = batch[:1000]
+		}
+		ids = ids[len(batch):]
+		res := BlobsResponse{}
+		if err := syncCall("/blobs", syncHeaders(), BlobsRequest{IDs: batch}, &res); err != nil {
+			return err
+		}
+		for _, id := range res.Missing {
+			missing[id] = true
+		}
+		for _, id := range batch {
+			if !have[id] {
+				continue
+			}
+			if missing[id] {
+				if err := syncBlobUpload(id, res.Offsets[id]); err != nil {
+					return err
+				}
+			}
+			if err := attachmentSynced(id); err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, id := range referenced {
+		if have[id] {
+			continue
+		} else if missing[id] {
+			// the device it was attached on hasn't uploaded it yet
+			log.Println("blob not on the server yet:", id)
+			continue
+		}
+		res, err := syncDo("GET", "/blobs/"+id, nil, syncHeaders())
+		var statusErr syncStatusError
+		if errors.As(err, &statusErr) && statusErr.Code == 404 {
+			log.Println("blob not on the server anymore:", id)
+			continue
+		} else if err != nil {
+			return err
+		}
+		data, err := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		if err != nil {
+			return err
+		}
+		if sum := sha256.Sum256(data); hex.EncodeToString(sum[:]) != id {
+			log.Println("skipping blob not matching its id:", id)
+			continue
+		}
+		if err := attachmentSave(id, data, true); err != nil {
+			return err
+		}
+		layoutLock.Lock()
+		delete(attachmentImages, id)
+		layoutLock.Unlock()
+		invalidate()
+	}
+
+	if time.Since(blobsCollected) < 24*time.Hour {
+		return nil
+	}
+	return syncBlobsCollect()
+}
+
+// syncBlobsReferenced lists the attachments our notes refer to
+func syncBlobsReferenced() []string {
+	layoutLock.Lock()
+	defer layoutLock.Unlock()
+	ids := []string{}
+	seen := map[string]bool{}
+	for _, i := range items {
+		for _, m := range attachmentRe.FindAllStringSubmatch(i.Data, -1) {
+			if !seen[m[3]] {
+				seen[m[3]] = true
+				ids = append(ids, m[3])
+			}
+		}
+	}
+	return ids
+}
+
+// syncBlobUpload sends a blob in parts, from offset as the server may have
+// the beginning of it already
+func syncBlobUpload(id string, offset int64) error {
+	data, err := attachmentLoad(id)
+	if err != nil {
+		return err
+	}
+	if offset > int64(len(data)) {
+		offset = 0
+	}
+	for {
+		end := offset + syncBlobPart
+		if end > int64(len(data)) {
+			end = int64(len(data))
+		}
+		path := fmt.Sprintf("/blobs/%s?offset=%d&size=%d", id, offset, len(data))
+		res, err := syncDo("PUT", path, bytes.NewReader(data[offset:end]), syncHeaders())
+		if err != nil {
+			return err
+		}
+		res.Body.Close()
+		if end == int64(len(data)) {
+			return nil
+		}
+		offset = end
+	}
+}
+
+// syncBlobsCollect has the server delete the blobs no note refers to, and
+// deletes them here too, the server keeps recent ones for notes still on
+// their way to us
+func syncBlobsCollect() error {
+	res := BlobsCollectResponse{}
+	keep := syncBlobsReferenced()
+	if err := syncCall("/blobs/gc", syncHeaders(), BlobsCollectRequest{Keep: keep}, &res); err != nil {
+		return err
+	}
+	blobsCollected = time.Now()
+	for _, id := range res.Deleted {
+		if err := attachmentDelete(id); err != nil {
+			return err
+		}
+	}
+	if len(res.Deleted) > 0 {
+		log.Printf("sync: deleted %d unused attachments, %d bytes", len(res.Deleted), res.Bytes)
+	}
+	return nil
+}
+
+// syncLogin proves we know the password to the server with srp, so neither
+// the password nor anything equivalent to it is sent, and gets a session token
+func syncLogin() error {
+	c, res, err := syncLoginStart()
+	if err != nil {
+		return err
+	}
+	if res.Enroll {
+		if err := syncEnroll(res.Legacy); err != nil {
+			return err
+		}
+		if c, res, err = syncLoginStart(); err != nil {
+			return err
+		}
+		if res.Enroll {
+			return errors.New("login: server didn't keep our enrollment")
+		}
+	}
+
+	proof, err := c.proof(res.Salt, authKey, res.B)
+	if err != nil {
+		return err
+	}
+	req := LoginRequest{HandshakeID: res.HandshakeID, Proof: proof}
+	res = LoginResponse{}
+	if err := syncCall("/login", nil, req, &res); err != nil {
+		return err
+	}
+	if !c.verify(res.Proof) {
+		return errors.New("login: server proof mismatch")
+	}
+	sessionToken = res.Token
+	sessionExpires = time.Unix(res.Expires, 0)
+	return nil
+}
+
+func syncLoginStart() (*srpClient, LoginResponse, error) {
+	c := srpClientStart()
+	req := LoginRequest{UserHash: userHash, A: c.A.Bytes(), DeviceID: settings.DeviceID, DeviceName: deviceName()}
+	res := LoginResponse{}
+	err := syncCall("/login", nil, req, &res)
+	return c, res, err
+}
+
+func deviceName() string {
+	name, err := os.Hostname()
+	if err != nil || name == "" {
+		name = runtime.GOOS
+	}
+	if len(name) > 64 {
+		name = name[:64]
+	}
+	return name
+}
+
+// syncSignup creates our account on the server, with an invite for servers
+// needing one, and logs in
+func syncSignup(invite string) error {
+	req := SignupRequest{UserHash: userHash, Salt: make([]byte, 32), Invite: invite}
+	_, err := rand.Read(req.Salt)
+	if err != nil {
+		return err
+	}
+	req.Verifier = srpVerifier(req.Salt, authKey)
+	log.Println("signing up with server")
+	if err := syncCall("/signup", nil, req, nil); err != nil {
+		return err
+	}
+	return syncLogin()
+}
+
+// syncEnroll gives the server our srp verifier, accounts created before srp
+// (legacy) prove themselves with the passkey they used to send on every sync
+func syncEnroll(legacy bool) error {
+	req := EnrollRequest{UserHash: userHash, Salt: make([]byte, 32)}
+	_, err := rand.Read(req.Salt)
+	if err != nil {
+		return err
+	}
+	req.Verifier = srpVerifier(req.Salt, authKey)
+	if legacy {
+		req.PassKey = authKey
+	}
+	log.Println("enrolling with server, legacy:", legacy)
+	return syncCall("/enroll", nil, req, nil)
+}
+
+// syncDevices lists the devices logged in to our account, revoking one first
+// when revoke is set
+func syncDevices(revoke string) ([]Device, error) {
+	if sessionToken == "" {
+		if err := syncLogin(); err != nil {
+			return nil, err
+		}
+	}
+	devices := []Device{}
+	err := syncCall("/devices", syncHeaders(), DevicesRequest{Revoke: revoke}, &devices)
+	return devices, err
+}
+
+// syncUsage gets what our account stores on the server
+func syncUsage() (Usage, error) {
+	usage := Usage{}
+	if sessionToken == "" {
+		if err := syncLogin(); err != nil {
+			return usage, err
+		}
+	}
+	res, err := syncDo("POST", "/usage", nil, syncHeaders())
+	if err != nil {
+		return usage, err
+	}
+	defer res.Body.Close()
+	return usage, gob.NewDecoder(res.Body).Decode(&usage)
+}
+
+// syncProtocol is the version of the sync protocol we speak, servers answer
+// 426 to versions they don't, since syncSealed we only send sealed items
+const (
+	syncProtocol = 3
+	syncSealed   = 3
+)
+
+func syncHeaders() map[string]string {
+	return map[string]string{"userhash": userHash, "session": sessionToken}
+}
+
+// syncCall posts in to the server and decodes its answer into out, if not nil
+func syncCall(path string, headers map[string]string, in interface{}, out interface{}) error {
+	res, err := syncRequest(path, in, headers)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if out == nil {
+		return nil
+	}
+	return gob.NewDecoder(res.Body).Decode(out)
+}
+
+func syncRequest(path string, in interface{}, headers map[string]string) (*http.Response, error) {
+	var bs bytes.Buffer
+	if err := gob.NewEncoder(&bs).Encode(in); err != nil {
+		return nil, err
+	}
+	return syncDo("POST", path, &bs, headers)
+}
+
+func syncDo(method, path string, body io.Reader, headers map[string]string) (*http.Response, error) {
+	req, err := http.NewRequest(method, apiUrl+path, body)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	req.Header.Set("protocol", strconv.Itoa(syncProtocol))
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode == 401 {
+		sessionToken = ""
+	}
+	if res.StatusCode/100 != 2 {
+		defer res.Body.Close()
+		return nil, syncReadError(res)
+	}
+	return res, nil
+}
@@ -3,7 +3,10 @@ package main
 import (
 	"crypto/aes"
 	"crypto/cipher"
+	"crypto/hmac"
 	"crypto/rand"
+	"crypto/sha256"
+	"errors"
 	"fmt"
 	"image"
 	"image/color"
@@ -60,8 +63,13 @@ func check(err error) {
 var idSeq int64 = 0
 
 func id() int64 {
+	return idAt(time.Now())
+}
+
+// idAt makes an id for something that happened at t
+func idAt(t time.Time) int64 {
 	seq := atomic.AddInt64(&idSeq, 1) - 1
-	id := time.Now().UnixNano()/int64(time.Millisecond) - 1262304000000
+	id := t.UnixNano()/int64(time.Millisecond) - 1262304000000
 	id <<= 12
 	id |= seq % 4096
 	return id
@@ -101,3 +109,95 @@ func textDecrypt(key []byte, data []byte) string {
 	mustCipher(key).Decrypt(data, data)
 	return strings.Trim(string(data), string(byte(0)))
 }
+
+// subKey derives a key for a single purpose from key
+func subKey(key []byte, purpose string) []byte {
+	m := hmac.New(sha256.New, key)
+	m.Write([]byte(purpose))
+	return m.Sum(nil)
+}
+
+func mustGCM(key []byte) cipher.AEAD {
+	gcm, err := cipher.NewGCM(mustCipher(key))
+	check(err)
+	return gcm
+}
+
+func seal(key []byte, data []byte) []byte {
+	return sealWith(key, data, nil)
+}
+
+func unseal(key []byte, data []byte) ([]byte, error) {
+	return unsealWith(key, data, nil)
+}
+
+// sealWith seals data bound to ad, which isn't encrypted but must be given
+// as is to unsealWith
+func sealWith(key, data, ad []byte) []byte {
+	gcm := mustGCM(key)
+	nonce := make([]byte, gcm.NonceSize(), gcm.NonceSize()+len(data)+gcm.Overhead())
+	_, err := rand.Read(nonce)
+	check(err)
+	return gcm.Seal(nonce, nonce, data, ad)
+}
+
+func unsealWith(key, data, ad []byte) ([]byte, error) {
+	gcm := mustGCM(key)
+	if len(data) < gcm.NonceSize() {
+		return nil, errors.New("unseal: data too short")
+	}
+	return gcm.Open(nil, data[:gcm.NonceSize()], data[gcm.NonceSize():], ad)
+}
+
+// sealConvergent seals data under a nonce derived from it, so the same data
+// always seals the same and can be deduplicated, which only reveals that two
+// sealed values are equal. unseal opens it.
+func sealConvergent(key, data []byte) []byte {
+	gcm := mustGCM(key)
+	m := hmac.New(sha256.New, subKey(key, "nonce"))
+	m.Write(data)
+	nonce := m.Sum(nil)[:gcm.NonceSize()]
+	return gcm.Seal(nonce, nonce, data, nil)
+}
+
+// passwordVerifier returns a random value followed by its MAC under a key
+// derived from key, so the password can be checked without the stored value
+// being usable for anything else
+func passwordVerifier(key []byte) []byte {
+	v := make([]byte, sha256.Size, sha256.Size*2)
+	_, err := rand.Read(v)
+	check(err)
+	m := hmac.New(sha256.New, subKey(key, "verifier"))
+	m.Write(v)
+	return m.Sum(v)
+}
+
+func passwordVerify(key []byte, verifier []byte) bool {
+	if len(verifier) != sha256.Size*2 {
+		return false
+	}
+	m := hmac.New(sha256.New, subKey(key, "verifier"))
+	m.Write(verifier[:sha256.Size])
+	return hmac.Equal(m.Sum(nil), verifier[sha256.Size:])
+}
+
+// formatSize writes a number of bytes for people to read
+func formatSize(n int64) string {
+	switch {
+	case n >= 1<<30:
+		return fmt.Sprintf("%.1fGB", float64(n)/(1<<30))
+	case n >= 1<<20:
+		return fmt.Sprintf("%.1fMB", float64(n)/(1<<20))
+	case n >= 1<<10:
+		return fmt.Sprintf("%.1fKB", float64(n)/(1<<10))
+	}
+	return fmt.Sprintf("%dB", n)
+}
+
+// formatUsage writes used, out of limit when there is one
+func formatUsage(used, limit int64, format func(int64) string) string {
+	if limit == 0 {
+		return format(used)
+	}
+	return format(used) + " of " + format(limit)
+}